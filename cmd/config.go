@@ -15,6 +15,7 @@ const (
 	DefaultServerTomlName = "server.toml"
 	DefaultFWMark         = 51820
 	AddPeerPath           = "/"
+	PeersPath             = "/peers"
 )
 
 var (
@@ -3,7 +3,9 @@ package main
 import (
 	"crypto/ecdh"
 	"crypto/rand"
+	"encoding/base64"
 	"encoding/gob"
+	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
@@ -13,6 +15,10 @@ import (
 	"net/url"
 	"os"
 	"path"
+	"slices"
+	"strings"
+	"text/tabwriter"
+	"time"
 
 	"wg-exchange/cmd"
 	"wg-exchange/models"
@@ -24,6 +30,10 @@ import (
 
 const (
 	confFormat     = "%s.conf"
+	netdevFormat   = "%s.netdev"
+	networkFormat  = "%s.network"
+	nmFormat       = "%s.nmconnection"
+	stateFormat    = "%s.state.json"
 	qrImageEncoder = standard.JPEG_FORMAT
 	qrFileFormat   = "%s.jpeg"
 	qrWidth        = 4
@@ -34,15 +44,23 @@ var (
 	certPath   = flag.String("cert", "client.pem", "tls client cert file, the first cert will be taken as the client cert. Any CAs in here will be considered in addition to the system CAs.")
 	keyPath    = flag.String("key", "client.key", "tls client key file")
 	endpoint   = flag.String("endpoint", "https://127.0.0.1:7777", "server endpoint")
+	clientName = flag.String("name", "", "client name to act on, required for revoke, filters list")
+	subject    = flag.String("subject", "", "filters list by client cert subject")
 	version    = flag.Bool("version", false, "version")
 )
 
+// keys needed to revoke the client later, written next to its conf
+type clientState struct {
+	Pub models.Key `json:"publicKey"`
+	Psk models.Key `json:"presharedKey"`
+}
+
 type clientProcessor struct {
 	url              *url.URL
 	defaultInterface models.Interface
 	client           *http.Client
 
-	keepAlive int8
+	keepAlive *uint16
 }
 
 func (c *clientProcessor) createQR(wgClient models.WgClient, buf []byte) error {
@@ -62,13 +80,39 @@ func (c *clientProcessor) createQR(wgClient models.WgClient, buf []byte) error {
 	return qr.Save(qrWriter)
 }
 
+// <name>/<name>.<ext>
+func openClientFile(wgClient models.WgClient, format string, mode os.FileMode) (*os.File, error) {
+	fPath := path.Join(wgClient.Name, fmt.Sprintf(format, wgClient.Name))
+	return os.OpenFile(fPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, mode)
+}
+
+// random (version 4), NetworkManager wants one per connection
+func newUUID() (string, error) {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	buf[6] = buf[6]&0x0f | 0x40
+	buf[8] = buf[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", buf[0:4], buf[4:6], buf[6:8], buf[8:10], buf[10:]), nil
+}
+
 func (c *clientProcessor) createClient(wgClient models.WgClient) error {
 	// make the folder
 	if err := os.Mkdir(wgClient.Name, 0o740); err != nil && !errors.Is(err, os.ErrExist) {
 		return err
 	}
-	fPath := path.Join(wgClient.Name, fmt.Sprintf(confFormat, wgClient.Name))
-	f, err := os.OpenFile(fPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o640)
+	// opened before enrolling so it fails early, NetworkManager ignores keyfiles readable by others
+	var f *os.File
+	var err error
+	switch wgClient.Format {
+	case models.FormatNetworkd:
+		f, err = openClientFile(wgClient, netdevFormat, 0o640)
+	case models.FormatNetworkManager:
+		f, err = openClientFile(wgClient, nmFormat, 0o600)
+	default:
+		f, err = openClientFile(wgClient, confFormat, 0o640)
+	}
 	if err != nil {
 		return err
 	}
@@ -82,33 +126,23 @@ func (c *clientProcessor) createClient(wgClient models.WgClient) error {
 	}
 	pub := priv.PublicKey()
 
-	r, w := io.Pipe()
-	val := models.Credentials{
-		Pub: pub.Bytes(),
-		Psk: psk.Bytes(),
+	val := models.EnrollRequest{
+		Credentials: models.Credentials{
+			Pub: pub.Bytes(),
+			Psk: psk.Bytes(),
+		},
+		Name:    wgClient.Name,
+		Routes:  wgClient.Routes,
+		Subnets: wgClient.Subnets,
 	}
 
-	go c.encode(w, &val)
-
-	addPeerURI := c.url
-	addPeerURI.Path = cmd.AddPeerPath
-
-	resp, err := c.client.Post(addPeerURI.String(), "application/octet-stream", r)
+	resp, err := c.send(http.MethodPost, cmd.AddPeerPath, &val)
 	if err != nil {
-		log.Println("http failure")
 		return err
 	}
 	defer resp.Body.Close()
-	log.Println(resp.Status)
-	if resp.StatusCode != http.StatusOK {
-
-		var buf []byte
-		if _, err := resp.Body.Read(buf); err != nil {
-			return err
-		} else {
-			log.Println("body:", string(buf))
-			return errors.New("status code other than 200")
-		}
+	if err := checkStatus(resp, http.StatusOK); err != nil {
+		return err
 	}
 
 	clientConf := &models.ClientConfig{}
@@ -121,30 +155,225 @@ func (c *clientProcessor) createClient(wgClient models.WgClient) error {
 		return errors.New("client has no peer")
 	}
 	clientConf.Intrfc.Priv = priv.Bytes()
-	// Set defaults as needed
-	clientConf.Intrfc.FwMark = c.defaultInterface.FwMark
-	clientConf.Intrfc.PreUp = c.defaultInterface.PreUp
-	clientConf.Intrfc.PreDown = c.defaultInterface.PreDown
-	clientConf.Intrfc.PostUp = c.defaultInterface.PostUp
-	clientConf.Intrfc.PostDown = c.defaultInterface.PostDown
-	clientConf.Peer[0].KeepAlive = c.keepAlive
+	if err := writeClientState(wgClient, clientState{Pub: val.Pub, Psk: val.Psk}); err != nil {
+		return err
+	}
+	// Set defaults as needed, the client's own interface values win over the global ones
+	intrfc := c.defaultInterface
+	if wgClient.Interface != nil {
+		intrfc = intrfc.Overlay(*wgClient.Interface)
+	}
+	clientConf.Intrfc.FwMark = intrfc.FwMark
+	clientConf.Intrfc.PreUp = intrfc.PreUp
+	clientConf.Intrfc.PreDown = intrfc.PreDown
+	clientConf.Intrfc.PostUp = intrfc.PostUp
+	clientConf.Intrfc.PostDown = intrfc.PostDown
+	clientConf.Intrfc.ListenPort = intrfc.ListenPort
+	clientConf.Intrfc.MTU = intrfc.MTU
+	clientConf.Intrfc.Table = intrfc.Table
+	clientConf.Intrfc.SaveConfig = intrfc.SaveConfig
+	// otherwise the DNS the server sent
+	if intrfc.Dns != nil {
+		clientConf.Intrfc.Dns = intrfc.Dns
+	}
+	// the server's policy may have picked one, only an explicit one here wins over it
+	if c.keepAlive != nil {
+		clientConf.Peer[0].KeepAlive = c.keepAlive
+	}
+	if wgClient.KeepAlive != nil {
+		clientConf.Peer[0].KeepAlive = wgClient.KeepAlive
+	}
+	if len(wgClient.ExcludeIps) != 0 {
+		if clientConf.Peer[0].Ips, err = models.SubtractAllowedIps(clientConf.Peer[0].Ips, wgClient.ExcludeIps); err != nil {
+			return err
+		}
+		if len(clientConf.Peer[0].Ips) == 0 {
+			log.Println("warning for client", wgClient.Name, "... ExcludeIPs leave no AllowedIPs, nothing goes through the tunnel")
+		}
+	}
+
+	platformConf, warnings, err := clientConf.ForPlatform(wgClient.Platform)
+	for _, val := range warnings {
+		log.Println("warning for client", wgClient.Name, "...", val)
+	}
+	if err != nil {
+		return err
+	}
 
-	buf, err := clientConf.MarshalText()
+	if wgClient.GenerateQR && !wgClient.Format.WgQuick() {
+		log.Println("warning for client", wgClient.Name, "... skipping the QR code, only made for wg-quick confs")
+	}
+	switch wgClient.Format {
+	case models.FormatNetworkd:
+		return c.writeNetworkd(wgClient, platformConf, f)
+	case models.FormatNetworkManager:
+		return c.writeNMConnection(wgClient, platformConf, f)
+	}
+
+	buf, err := platformConf.MarshalText()
 	if err != nil {
 		return err
 	} else if _, err := fmt.Fprint(f, string(buf)); err != nil {
 		return err
 	}
 
-	if wgClient.GenerateQR {
+	if wgClient.GenerateQR && !wgClient.Platform.QR() {
+		log.Println("warning for client", wgClient.Name, "... skipping the QR code, not imported on", wgClient.Platform)
+	} else if wgClient.GenerateQR {
 		return c.createQR(wgClient, buf)
 	}
 	return nil
 }
 
-func (c *clientProcessor) encode(w io.WriteCloser, val *models.Credentials) {
-	defer w.Close()
-	gob.NewEncoder(w).Encode(val)
+// .netdev into f, the .network next to it
+func (c *clientProcessor) writeNetworkd(wgClient models.WgClient, clientConf models.ClientConfig, f *os.File) error {
+	netdev, network, warnings, err := clientConf.MarshalNetworkd(wgClient.Name)
+	for _, val := range warnings {
+		log.Println("warning for client", wgClient.Name, "...", val)
+	}
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(netdev); err != nil {
+		return err
+	}
+
+	nf, err := openClientFile(wgClient, networkFormat, 0o644)
+	if err != nil {
+		return err
+	}
+	defer nf.Close()
+	_, err = nf.Write(network)
+	return err
+}
+
+func (c *clientProcessor) writeNMConnection(wgClient models.WgClient, clientConf models.ClientConfig, f *os.File) error {
+	uuid, err := newUUID()
+	if err != nil {
+		return err
+	}
+	buf, warnings, err := clientConf.MarshalNMConnection(wgClient.Name, uuid)
+	for _, val := range warnings {
+		log.Println("warning for client", wgClient.Name, "...", val)
+	}
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(buf)
+	return err
+}
+
+func (c *clientProcessor) revokeClient(wgClient models.WgClient) error {
+	fPath := path.Join(wgClient.Name, fmt.Sprintf(stateFormat, wgClient.Name))
+	buf, err := os.ReadFile(fPath)
+	if err != nil {
+		return err
+	}
+	var state clientState
+	if err := json.Unmarshal(buf, &state); err != nil {
+		return err
+	}
+
+	resp, err := c.send(http.MethodDelete, cmd.PeersPath, &models.Credentials{Pub: state.Pub, Psk: state.Psk})
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if err := checkStatus(resp, http.StatusNoContent); err != nil {
+		return err
+	}
+	// the conf is useless now, but leave it for the user to clean up
+	return os.Remove(fPath)
+}
+
+func writeClientState(wgClient models.WgClient, state clientState) error {
+	buf, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	fPath := path.Join(wgClient.Name, fmt.Sprintf(stateFormat, wgClient.Name))
+	return os.WriteFile(fPath, buf, 0o600)
+}
+
+func (c *clientProcessor) listPeers(name string, subject string) error {
+	uri := *c.url
+	uri.Path = cmd.PeersPath
+	query := url.Values{}
+	if name != "" {
+		query.Set("name", name)
+	}
+	if subject != "" {
+		query.Set("subject", subject)
+	}
+	uri.RawQuery = query.Encode()
+
+	resp, err := c.client.Get(uri.String())
+	if err != nil {
+		log.Println("http failure")
+		return err
+	}
+	defer resp.Body.Close()
+	if err := checkStatus(resp, http.StatusOK); err != nil {
+		return err
+	}
+
+	var peers []models.PeerInfo
+	if err := json.NewDecoder(resp.Body).Decode(&peers); err != nil {
+		return err
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "NAME\tPUBLIC KEY\tADDRESS\tENROLLED\tSUBJECT\tREMOTE ADDR\tSUBNETS")
+	for _, val := range peers {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n",
+			val.Name,
+			base64.StdEncoding.EncodeToString(val.PublicKey),
+			strings.Join(val.Address, ", "),
+			val.Enrolled.Local().Format(time.DateTime),
+			val.Subject,
+			val.RemoteAddr,
+			strings.Join(val.Subnets, ", "),
+		)
+	}
+	return tw.Flush()
+}
+
+// gob encoded body, streamed through a pipe
+func (c *clientProcessor) send(method string, uriPath string, val any) (*http.Response, error) {
+	r, w := io.Pipe()
+	go c.encode(w, val)
+
+	uri := *c.url
+	uri.Path = uriPath
+	req, err := http.NewRequest(method, uri.String(), r)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/octet-stream")
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		log.Println("http failure")
+		return nil, err
+	}
+	log.Println(resp.Status)
+	return resp, nil
+}
+
+func checkStatus(resp *http.Response, expected int) error {
+	if resp.StatusCode == expected {
+		return nil
+	}
+	buf, err := io.ReadAll(io.LimitReader(resp.Body, 1<<10))
+	if err != nil {
+		return err
+	}
+	log.Println("body:", string(buf))
+	return fmt.Errorf("status code other than %d", expected)
+}
+
+func (c *clientProcessor) encode(w *io.PipeWriter, val any) {
+	w.CloseWithError(gob.NewEncoder(w).Encode(val))
 }
 
 func validateEndpoint(endpoint string) (url *url.URL, err error) {
@@ -171,15 +400,34 @@ func main() {
 		return
 	}
 	var wgeConf models.WGEClientConf
+	mode := flag.Arg(0)
 
-	if _, err := toml.DecodeFile(*configFile, &wgeConf); err != nil {
-		log.Println("invalid toml conf file", err)
-		return
-	}
+	// listing only needs the endpoint and certs
+	if mode != "list" {
+		if _, err := toml.DecodeFile(*configFile, &wgeConf); err != nil {
+			log.Println("invalid toml conf file", err)
+			return
+		}
 
-	if len(wgeConf.Client.Clients) == 0 {
-		log.Println("no client interfaces found")
-		return
+		if len(wgeConf.Client.Clients) == 0 {
+			log.Println("no client interfaces found")
+			return
+		}
+		for _, val := range wgeConf.Client.Clients {
+			if val.Interface != nil && (val.Interface.Address != nil || val.Interface.Priv != nil) {
+				log.Println("invalid interface for client", val.Name, "... Address and PrivateKey come from the server")
+				return
+			}
+			// checked up front, the conf is only worked out after the enrollment
+			if _, err := models.SubtractAllowedIps(nil, val.ExcludeIps); err != nil {
+				log.Println("invalid exclude ips for client", val.Name, "...", err)
+				return
+			}
+			if !val.Format.WgQuick() && !val.Platform.Linux() {
+				log.Println("invalid format for client", val.Name, "...", val.Format, "is only for linux hosts")
+				return
+			}
+		}
 	}
 
 	url, err := validateEndpoint(*endpoint)
@@ -206,14 +454,33 @@ func main() {
 		},
 	}
 
-	// each should a different name so they don't overwrite
-	for _, val := range wgeConf.Client.Clients {
-		log.Println("trying client -", val.Name)
-		if err := proc.createClient(val); err != nil {
-			log.Println(err)
+	switch mode {
+	case "", "enroll":
+		// each should a different name so they don't overwrite
+		for _, val := range wgeConf.Client.Clients {
+			log.Println("trying client -", val.Name)
+			if err := proc.createClient(val); err != nil {
+				log.Println(err)
+			} else {
+				log.Println("successfully created client -", val.Name)
+			}
+		}
+	case "revoke":
+		idx := slices.IndexFunc(wgeConf.Client.Clients, func(c models.WgClient) bool { return c.Name == *clientName })
+		if *clientName == "" || idx < 0 {
+			log.Println("revoke needs a client name from the conf file, use -name")
+			return
+		}
+		if err := proc.revokeClient(wgeConf.Client.Clients[idx]); err != nil {
+			log.Println("revoke failure...", err)
 		} else {
-			log.Println("successfully created client -", val.Name)
+			log.Println("successfully revoked client -", *clientName)
 		}
-
+	case "list":
+		if err := proc.listPeers(*clientName, *subject); err != nil {
+			log.Println("list failure...", err)
+		}
+	default:
+		log.Println("unknown mode:", mode)
 	}
 }
@@ -1,7 +1,8 @@
-// extremely volatile, will keep the service enabled if there is a failure somewhere
+// systemd over the system D-Bus, unit jobs are waited on until systemd removes them
 package dbusclient
 
 import (
+	"errors"
 	"fmt"
 	"log"
 	"sync"
@@ -13,6 +14,13 @@ import (
 const (
 	wireguardServiceFormat = "wg-quick@%s.service"
 	modeReplace            = "replace"
+	systemdDest            = "org.freedesktop.systemd1"
+	managerInterface       = "org.freedesktop.systemd1.Manager"
+	unitInterface          = "org.freedesktop.systemd1.Unit"
+	jobRemovedMember       = "JobRemoved"
+	jobResultDone          = "done"
+	unitActive             = "active"
+	jobTimeout             = 30 * time.Second
 )
 
 var systemdManager SystemdManager
@@ -21,11 +29,24 @@ var DefaultSystemdManager = &systemdManager
 // refer: https://www.freedesktop.org/software/systemd/man/latest/org.freedesktop.systemd1.html
 
 /**
+StartUnit(in  s name,
+		  in  s mode,
+		  out o job);
+StopUnit(in  s name,
+		 in  s mode,
+		 out o job);
 RestartUnit(in  s name,
 			in  s mode,
 			out o job);
 */
 
+/**
+JobRemoved(u  id,
+		   o  job,
+		   s  unit,
+		   s  result);
+*/
+
 /**
 EnableUnitFiles(in  as files,
                 in  b runtime,
@@ -48,108 +69,211 @@ type Changes struct {
 
 type CarriesInstallInfo bool
 
+// Job finished with anything other than done: canceled, timeout, failed, dependency or skipped
+type JobError struct {
+	Unit        string
+	Result      string
+	ActiveState string
+	SubState    string
+}
+
+func (e *JobError) Error() string {
+	return fmt.Sprintf("job for %s finished with result %s (%s/%s)", e.Unit, e.Result, e.ActiveState, e.SubState)
+}
+
 type SystemdManager struct {
-	m          sync.Mutex
-	conn       *dbus.Conn
-	obj        dbus.BusObject
-	enableDbus bool
+	m       sync.Mutex
+	conn    *dbus.Conn
+	obj     dbus.BusObject
+	runtime bool
 }
 
 func (d *SystemdManager) connect() (err error) {
-	d.conn, err = dbus.ConnectSystemBus()
-	d.obj = d.conn.Object("org.freedesktop.systemd1", "/org/freedesktop/systemd1")
+	if d.conn, err = dbus.ConnectSystemBus(); err != nil {
+		return err
+	}
+	d.obj = d.conn.Object(systemdDest, "/org/freedesktop/systemd1")
 	return
 }
 
-func (d *SystemdManager) disconnect() error {
-	return d.conn.Close()
-}
-
-func (d *SystemdManager) SetDbusSystemdManager(enableInd bool) {
+// enable and disable under /run instead of /etc
+func (d *SystemdManager) SetRuntimeEnable(runtime bool) {
 	d.m.Lock()
 	defer d.m.Unlock()
-	d.enableDbus = enableInd
+	d.runtime = runtime
+}
+
+// has to happen before the job is queued, it can be removed before the call even returns
+func (d *SystemdManager) subscribe() (chan *dbus.Signal, error) {
+	if err := d.conn.AddMatchSignal(dbus.WithMatchInterface(managerInterface), dbus.WithMatchMember(jobRemovedMember)); err != nil {
+		return nil, err
+	}
+	ch := make(chan *dbus.Signal, 16)
+	d.conn.Signal(ch)
+
+	// systemd only emits job signals to subscribed clients
+	if call := d.obj.Call(managerInterface+".Subscribe", 0); call.Err != nil {
+		d.conn.RemoveSignal(ch)
+		return nil, call.Err
+	}
+	return ch, nil
 }
 
-// TODO: start service part
+func (d *SystemdManager) unitState(service string) (activeState string, subState string, err error) {
+	var unitPath dbus.ObjectPath
+	if err := d.obj.Call(managerInterface+".LoadUnit", 0, service).Store(&unitPath); err != nil {
+		return "", "", err
+	}
+	unit := d.conn.Object(systemdDest, unitPath)
+
+	active, err1 := unit.GetProperty(unitInterface + ".ActiveState")
+	sub, err2 := unit.GetProperty(unitInterface + ".SubState")
+	if err := errors.Join(err1, err2); err != nil {
+		return "", "", err
+	}
+	activeState, _ = active.Value().(string)
+	subState, _ = sub.Value().(string)
+	return activeState, subState, nil
+}
+
+// queues a unit job (StartUnit, RestartUnit...) and blocks until systemd reports it removed
+func (d *SystemdManager) runJob(method string, service string) error {
+	ch, err := d.subscribe()
+	if err != nil {
+		return err
+	}
+	defer d.conn.RemoveSignal(ch)
+
+	var job dbus.ObjectPath
+	if err := d.obj.Call(managerInterface+"."+method, 0, service, modeReplace).Store(&job); err != nil {
+		return err
+	}
+	log.Println("dispatched job:", method, service, job)
+
+	timer := time.NewTimer(jobTimeout)
+	defer timer.Stop()
+	for {
+		select {
+		case sig, ok := <-ch:
+			if !ok {
+				return errors.New("dbus connection closed while waiting for job")
+			}
+			if sig.Name != managerInterface+"."+jobRemovedMember || len(sig.Body) < 4 {
+				continue
+			}
+			if path, ok := sig.Body[1].(dbus.ObjectPath); !ok || path != job {
+				continue
+			}
+			result, _ := sig.Body[3].(string)
+
+			active, sub, err := d.unitState(service)
+			if err != nil {
+				return err
+			}
+			if result != jobResultDone {
+				return &JobError{Unit: service, Result: result, ActiveState: active, SubState: sub}
+			}
+			log.Println("job done:", method, service, "-", active, sub)
+			return nil
+		case <-timer.C:
+			return fmt.Errorf("timed out waiting for %s job on %s", method, service)
+		}
+	}
+}
+
+func (d *SystemdManager) disconnect() error {
+	return d.conn.Close()
+}
+
+// Runtime enable only lasts until the next reboot, see SetRuntimeEnable
 func (d *SystemdManager) EnableAndStartService(intrfc string) error {
 	d.m.Lock()
 	defer d.m.Unlock()
 
 	service := fmt.Sprintf(wireguardServiceFormat, intrfc)
 
-	if d.enableDbus {
-		if err := d.connect(); err != nil {
-			return err
-		}
-		defer d.disconnect()
+	if err := d.connect(); err != nil {
+		return err
+	}
+	defer d.disconnect()
 
-		var carriesInstallInfo CarriesInstallInfo
-		var changes []Changes
+	var carriesInstallInfo CarriesInstallInfo
+	var changes []Changes
 
-		call := d.obj.Call("org.freedesktop.systemd1.Manager.EnableUnitFiles", 0, []string{service}, false, false)
-		if call.Err != nil {
-			return call.Err
-		}
+	call := d.obj.Call(managerInterface+".EnableUnitFiles", 0, []string{service}, d.runtime, false)
+	if call.Err != nil {
+		return call.Err
+	}
 
-		if err := call.Store(&carriesInstallInfo, &changes); err != nil {
-			return err
-		}
+	if err := call.Store(&carriesInstallInfo, &changes); err != nil {
+		return err
+	}
 
-		if len(changes) == 0 {
-			log.Println("service is already previously enabled")
-		} else {
-			log.Println("service enabled - file:", changes[0].FileName, ", dest:", changes[0].Destination)
+	if len(changes) == 0 {
+		log.Println("service is already previously enabled")
+	} else {
+		log.Println("service enabled - file:", changes[0].FileName, ", dest:", changes[0].Destination, ", runtime:", d.runtime)
 
-		}
+	}
 
-		// wait for 2 secs,
-		// TODO: refactor this using dbus systemd1 signals, and start this service here
-		<-time.NewTimer(2 * time.Second).C
-	} else {
-		log.Println("simulating enable service:", service)
+	// a start job on an active unit is a no-op, restart it so the freshly written conf is picked up
+	active, _, err := d.unitState(service)
+	if err != nil {
+		return err
 	}
+	if active == unitActive {
+		return d.runJob("RestartUnit", service)
+	}
+	return d.runJob("StartUnit", service)
+}
+
+func (d *SystemdManager) StopService(intrfc string) error {
+	d.m.Lock()
+	defer d.m.Unlock()
+
+	service := fmt.Sprintf(wireguardServiceFormat, intrfc)
 
-	return nil
+	if err := d.connect(); err != nil {
+		return err
+	}
+	defer d.disconnect()
+
+	return d.runJob("StopUnit", service)
 }
 
-// TODO: stop service part
 func (d *SystemdManager) DisableAndStopService(intrfc string) error {
 	d.m.Lock()
 	defer d.m.Unlock()
 
 	service := fmt.Sprintf(wireguardServiceFormat, intrfc)
 
-	if d.enableDbus {
-		if err := d.connect(); err != nil {
-			return err
-		}
-		defer d.disconnect()
-
-		var changes []Changes
+	if err := d.connect(); err != nil {
+		return err
+	}
+	defer d.disconnect()
 
-		call := d.obj.Call("org.freedesktop.systemd1.Manager.DisableUnitFiles", 0, []string{service}, false)
-		if call.Err != nil {
-			return call.Err
-		}
+	// stop first, a failed stop still shouldn't leave it enabled
+	stopErr := d.runJob("StopUnit", service)
 
-		if err := call.Store(&changes); err != nil {
-			return err
-		}
+	var changes []Changes
 
-		if len(changes) == 0 {
-			log.Println("service is already previously disabled")
-		} else {
-			log.Println("service disabled - file:", changes[0].FileName, ", dest:", changes[0].Destination)
+	call := d.obj.Call(managerInterface+".DisableUnitFiles", 0, []string{service}, d.runtime)
+	if call.Err != nil {
+		return errors.Join(stopErr, call.Err)
+	}
 
-		}
+	if err := call.Store(&changes); err != nil {
+		return errors.Join(stopErr, err)
+	}
 
-		// TODO: refactor this using dbus systemd1 signals, and end this service here
+	if len(changes) == 0 {
+		log.Println("service is already previously disabled")
 	} else {
-		log.Println("simulating disable service:", service)
+		log.Println("service disabled - file:", changes[0].FileName, ", dest:", changes[0].Destination)
+
 	}
 
-	return nil
+	return stopErr
 }
 
 func (d *SystemdManager) RestartService(intrfc string) error {
@@ -158,25 +282,10 @@ func (d *SystemdManager) RestartService(intrfc string) error {
 
 	service := fmt.Sprintf(wireguardServiceFormat, intrfc)
 
-	if d.enableDbus {
-		if err := d.connect(); err != nil {
-			return err
-		}
-		defer d.disconnect()
-
-		call := d.obj.Call("org.freedesktop.systemd1.Manager.RestartUnit", 0, service, modeReplace)
-		if call.Err != nil {
-			return call.Err
-		}
-		log.Println("successfully dispatched restart job")
-
-		// wait for 2 secs,
-		// TODO: refactor this using dbus systemd1 signals
-		<-time.NewTimer(2 * time.Second).C
-	} else {
-		log.Println("simulating restart service:", service)
+	if err := d.connect(); err != nil {
+		return err
 	}
+	defer d.disconnect()
 
-	return nil
-
+	return d.runJob("RestartUnit", service)
 }
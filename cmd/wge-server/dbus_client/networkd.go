@@ -0,0 +1,28 @@
+package dbusclient
+
+import (
+	"github.com/godbus/dbus/v5"
+)
+
+const (
+	networkdDest             = "org.freedesktop.network1"
+	networkdPath             = "/org/freedesktop/network1"
+	networkdManagerInterface = "org.freedesktop.network1.Manager"
+)
+
+// refer: https://www.freedesktop.org/software/systemd/man/latest/org.freedesktop.network1.html
+
+/**
+Reload();
+*/
+
+// networkd re-reads its .netdev/.network files, new netdevs are created but existing ones are left as they are
+func ReloadNetworkd() error {
+	conn, err := dbus.ConnectSystemBus()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	return conn.Object(networkdDest, networkdPath).Call(networkdManagerInterface+".Reload", 0).Err
+}
@@ -0,0 +1,309 @@
+// host address allocation over the interface prefixes
+package ipam
+
+import (
+	"errors"
+	"fmt"
+	"net/netip"
+	"sort"
+	"strings"
+)
+
+var (
+	ErrExhausted  = errors.New("network filled, no more peers can be added")
+	ErrNotInPool  = errors.New("address outside of the interface networks")
+	ErrNotFree    = errors.New("address already allocated or reserved")
+	ErrDoubleFree = errors.New("address is already free")
+)
+
+// Inclusive address range, parsed from "a-b", a prefix, or a single address
+type Range struct {
+	First netip.Addr
+	Last  netip.Addr
+}
+
+func ParseRange(s string) (Range, error) {
+	if first, last, ok := strings.Cut(s, "-"); ok {
+		f, err1 := netip.ParseAddr(strings.TrimSpace(first))
+		l, err2 := netip.ParseAddr(strings.TrimSpace(last))
+		if err := errors.Join(err1, err2); err != nil {
+			return Range{}, err
+		}
+		if f.BitLen() != l.BitLen() || l.Less(f) {
+			return Range{}, fmt.Errorf("invalid range %s", s)
+		}
+		return Range{First: f, Last: l}, nil
+	}
+	if strings.Contains(s, "/") {
+		p, err := netip.ParsePrefix(s)
+		if err != nil {
+			return Range{}, err
+		}
+		return prefixRange(p), nil
+	}
+	a, err := netip.ParseAddr(s)
+	if err != nil {
+		return Range{}, err
+	}
+	return Range{First: a, Last: a}, nil
+}
+
+func (r Range) Contains(addr netip.Addr) bool {
+	return !addr.Less(r.First) && !r.Last.Less(addr)
+}
+
+func prefixRange(p netip.Prefix) Range {
+	p = p.Masked()
+	last := p.Addr().AsSlice()
+	for i := p.Bits(); i < len(last)*8; i++ {
+		last[i/8] |= 1 << (7 - i%8)
+	}
+	l, _ := netip.AddrFromSlice(last)
+	return Range{First: p.Addr(), Last: l}
+}
+
+// free addresses of a single prefix as sorted, disjoint and non adjacent ranges.
+// Taking the lowest address is O(1), everything else is a binary search over the ranges,
+// so the cost depends on the fragmentation rather than on the number of peers.
+type pool struct {
+	prefix netip.Prefix
+	free   []Range
+}
+
+func newPool(prefix netip.Prefix) *pool {
+	r := prefixRange(prefix)
+	// network address (subnet-router anycast for v6) and v4 broadcast aren't usable by hosts
+	if prefix.Bits() < prefix.Addr().BitLen()-1 {
+		r.First = r.First.Next()
+		if prefix.Addr().Is4() {
+			r.Last = r.Last.Prev()
+		}
+	}
+	return &pool{prefix: prefix, free: []Range{r}}
+}
+
+// index of the first range that ends at or after addr
+func (p *pool) search(addr netip.Addr) int {
+	return sort.Search(len(p.free), func(i int) bool {
+		return !p.free[i].Last.Less(addr)
+	})
+}
+
+func (p *pool) take() (netip.Addr, error) {
+	if len(p.free) == 0 {
+		return netip.Addr{}, ErrExhausted
+	}
+	addr := p.free[0].First
+	if addr == p.free[0].Last {
+		p.free = p.free[1:]
+	} else {
+		p.free[0].First = addr.Next()
+	}
+	return addr, nil
+}
+
+// lowest free address inside any of the ranges, O(ranges * log free)
+func (p *pool) takeWithin(within []Range) (netip.Addr, error) {
+	var found netip.Addr
+	for _, r := range within {
+		i := p.search(r.First)
+		if i == len(p.free) || r.Last.Less(p.free[i].First) {
+			continue
+		}
+		addr := r.First
+		if addr.Less(p.free[i].First) {
+			addr = p.free[i].First
+		}
+		if !found.IsValid() || addr.Less(found) {
+			found = addr
+		}
+	}
+	if !found.IsValid() {
+		return netip.Addr{}, ErrExhausted
+	}
+	return found, p.remove(found)
+}
+
+func (p *pool) remove(addr netip.Addr) error {
+	i := p.search(addr)
+	if i == len(p.free) || addr.Less(p.free[i].First) {
+		return ErrNotFree
+	}
+	r := p.free[i]
+	switch {
+	case r.First == r.Last:
+		p.free = append(p.free[:i], p.free[i+1:]...)
+	case addr == r.First:
+		p.free[i].First = addr.Next()
+	case addr == r.Last:
+		p.free[i].Last = addr.Prev()
+	default:
+		p.free[i].Last = addr.Prev()
+		p.free = append(p.free, Range{})
+		copy(p.free[i+2:], p.free[i+1:])
+		p.free[i+1] = Range{First: addr.Next(), Last: r.Last}
+	}
+	return nil
+}
+
+// clamp the range to the pool and remove every free address in it
+func (p *pool) removeRange(r Range) {
+	full := prefixRange(p.prefix)
+	if r.Last.Less(full.First) || full.Last.Less(r.First) {
+		return
+	}
+	if r.First.Less(full.First) {
+		r.First = full.First
+	}
+	if full.Last.Less(r.Last) {
+		r.Last = full.Last
+	}
+
+	kept := make([]Range, 0, len(p.free)+1)
+	for _, val := range p.free {
+		if val.Last.Less(r.First) || r.Last.Less(val.First) {
+			kept = append(kept, val)
+			continue
+		}
+		if val.First.Less(r.First) {
+			kept = append(kept, Range{First: val.First, Last: r.First.Prev()})
+		}
+		if r.Last.Less(val.Last) {
+			kept = append(kept, Range{First: r.Last.Next(), Last: val.Last})
+		}
+	}
+	p.free = kept
+}
+
+func (p *pool) add(addr netip.Addr) error {
+	i := p.search(addr)
+	if i < len(p.free) && !addr.Less(p.free[i].First) {
+		return ErrDoubleFree
+	}
+	mergePrev := i > 0 && p.free[i-1].Last.Next() == addr
+	mergeNext := i < len(p.free) && addr.Next() == p.free[i].First
+
+	switch {
+	case mergePrev && mergeNext:
+		p.free[i-1].Last = p.free[i].Last
+		p.free = append(p.free[:i], p.free[i+1:]...)
+	case mergePrev:
+		p.free[i-1].Last = addr
+	case mergeNext:
+		p.free[i].First = addr
+	default:
+		p.free = append(p.free, Range{})
+		copy(p.free[i+1:], p.free[i:])
+		p.free[i] = Range{First: addr, Last: addr}
+	}
+	return nil
+}
+
+// One pool per interface prefix, v4 and v6 prefixes are allocated independently of each other
+type Allocator struct {
+	pools []*pool
+}
+
+// The interface's own addresses and the reserved ranges are never handed out
+func New(prefixes []netip.Prefix, reserved []Range) (*Allocator, error) {
+	a := &Allocator{pools: make([]*pool, 0, len(prefixes))}
+	for _, val := range prefixes {
+		if !val.IsValid() {
+			return nil, errors.New("invalid prefix")
+		}
+		p := newPool(val)
+		for _, r := range reserved {
+			p.removeRange(r)
+		}
+		// might already be gone if reserved explicitly, doesn't matter
+		p.remove(val.Addr())
+		a.pools = append(a.pools, p)
+	}
+	return a, nil
+}
+
+func (a *Allocator) poolFor(addr netip.Addr) (*pool, error) {
+	for _, val := range a.pools {
+		if val.prefix.Contains(addr) {
+			return val, nil
+		}
+	}
+	return nil, ErrNotInPool
+}
+
+// Lowest free host address of every prefix, in the order the prefixes were given
+func (a *Allocator) Allocate() ([]netip.Addr, error) {
+	addrs := make([]netip.Addr, 0, len(a.pools))
+	for _, val := range a.pools {
+		addr, err := val.take()
+		if err != nil {
+			a.Release(addrs...)
+			return nil, err
+		}
+		addrs = append(addrs, addr)
+	}
+	return addrs, nil
+}
+
+// Same as Allocate, but pools with any of the ranges in them only hand out addresses inside those.
+// Pools without any are allocated from as a whole, a v4 only restriction still gets a v6 address.
+func (a *Allocator) AllocateWithin(within []Range) ([]netip.Addr, error) {
+	addrs := make([]netip.Addr, 0, len(a.pools))
+	for _, val := range a.pools {
+		var inPool []Range
+		for _, r := range within {
+			if val.prefix.Contains(r.First) || val.prefix.Contains(r.Last) {
+				inPool = append(inPool, r)
+			}
+		}
+
+		var addr netip.Addr
+		var err error
+		if len(inPool) == 0 {
+			addr, err = val.take()
+		} else {
+			addr, err = val.takeWithin(inPool)
+		}
+		if err != nil {
+			a.Release(addrs...)
+			return nil, err
+		}
+		addrs = append(addrs, addr)
+	}
+	return addrs, nil
+}
+
+// Mark already assigned addresses as used, fails on collisions
+func (a *Allocator) Reserve(addrs ...netip.Addr) error {
+	for i, val := range addrs {
+		p, err := a.poolFor(val)
+		if err == nil {
+			err = p.remove(val)
+		}
+		if err != nil {
+			a.Release(addrs[:i]...)
+			return fmt.Errorf("%s: %w", val, err)
+		}
+	}
+	return nil
+}
+
+// Return addresses to their pools, unknown or already free addresses are ignored
+func (a *Allocator) Release(addrs ...netip.Addr) {
+	for _, val := range addrs {
+		if p, err := a.poolFor(val); err == nil {
+			p.add(val)
+		}
+	}
+}
+
+// Take a whole prefix out of the pool containing it, for routes that aren't single addresses.
+// Routes wider than a pool (0.0.0.0/0...) aren't peer addresses and are ignored.
+func (a *Allocator) ReservePrefix(prefix netip.Prefix) {
+	r := prefixRange(prefix)
+	for _, val := range a.pools {
+		if val.prefix.Overlaps(prefix) && prefix.Bits() >= val.prefix.Bits() {
+			val.removeRange(r)
+		}
+	}
+}
@@ -0,0 +1,114 @@
+package ipam
+
+import (
+	"net/netip"
+	"testing"
+)
+
+func TestAllocateSkipsReservedAndServer(t *testing.T) {
+	r, err := ParseRange("192.168.1.2-192.168.1.3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, err := New([]netip.Prefix{
+		netip.MustParsePrefix("192.168.1.1/24"),
+		netip.MustParsePrefix("fe80:1::1/120"),
+	}, []Range{r})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	addrs, err := a.Allocate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if addrs[0] != netip.MustParseAddr("192.168.1.4") || addrs[1] != netip.MustParseAddr("fe80:1::2") {
+		t.Fatal("unexpected allocation:", addrs)
+	}
+
+	// freed addresses are handed out again before higher ones
+	a.Release(addrs...)
+	if again, err := a.Allocate(); err != nil || again[0] != addrs[0] || again[1] != addrs[1] {
+		t.Fatal("released addresses not reused:", again, err)
+	}
+
+	if err := a.Reserve(netip.MustParseAddr("192.168.1.4")); err == nil {
+		t.Fatal("reserved an allocated address")
+	}
+	if err := a.Reserve(netip.MustParseAddr("10.0.0.1")); err == nil {
+		t.Fatal("reserved an address outside the pools")
+	}
+}
+
+func TestAllocateExhaustsV4(t *testing.T) {
+	a, err := New([]netip.Prefix{netip.MustParsePrefix("10.0.0.1/29")}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// .0 network, .1 server, .7 broadcast
+	for _, want := range []string{"10.0.0.2", "10.0.0.3", "10.0.0.4", "10.0.0.5", "10.0.0.6"} {
+		addrs, err := a.Allocate()
+		if err != nil || addrs[0] != netip.MustParseAddr(want) {
+			t.Fatal("expected", want, "got", addrs, err)
+		}
+	}
+	if _, err := a.Allocate(); err != ErrExhausted {
+		t.Fatal("expected exhaustion, got", err)
+	}
+
+	// release from the middle and reclaim it
+	a.Release(netip.MustParseAddr("10.0.0.4"))
+	if addrs, err := a.Allocate(); err != nil || addrs[0] != netip.MustParseAddr("10.0.0.4") {
+		t.Fatal("middle release not reused:", addrs, err)
+	}
+}
+
+func TestLargeV6Prefix(t *testing.T) {
+	a, err := New([]netip.Prefix{netip.MustParsePrefix("fd00::1/64")}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var last netip.Addr
+	for range 5000 {
+		addrs, err := a.Allocate()
+		if err != nil {
+			t.Fatal(err)
+		}
+		last = addrs[0]
+	}
+	if last != netip.MustParseAddr("fd00::1389") {
+		t.Fatal("unexpected last address:", last)
+	}
+	if len(a.pools[0].free) != 1 {
+		t.Fatal("free list fragmented:", len(a.pools[0].free))
+	}
+}
+
+func TestAllocateWithin(t *testing.T) {
+	a, err := New([]netip.Prefix{
+		netip.MustParsePrefix("10.0.0.1/24"),
+		netip.MustParsePrefix("fd00::1/120"),
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	within, err := ParseRange("10.0.0.128/31")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the v6 pool has no range in it and is allocated from as a whole
+	for _, expected := range []string{"10.0.0.128", "10.0.0.129"} {
+		addrs, err := a.AllocateWithin([]Range{within})
+		if err != nil || addrs[0] != netip.MustParseAddr(expected) || addrs[1].Is4() {
+			t.Fatal("expected", expected, "got", addrs, err)
+		}
+	}
+	if _, err := a.AllocateWithin([]Range{within}); err != ErrExhausted {
+		t.Fatal("expected the range exhausted, got", err)
+	}
+	// nothing stays taken by the failed allocation
+	if addrs, err := a.Allocate(); err != nil || addrs[0] != netip.MustParseAddr("10.0.0.2") || addrs[1] != netip.MustParseAddr("fd00::4") {
+		t.Fatal("unexpected allocation:", addrs, err)
+	}
+}
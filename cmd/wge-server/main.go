@@ -7,9 +7,9 @@ import (
 	"os"
 
 	"wg-exchange/cmd"
-	dbusclient "wg-exchange/cmd/wge-server/dbus_client"
 	"wg-exchange/cmd/wge-server/processor"
 	"wg-exchange/cmd/wge-server/server"
+	"wg-exchange/cmd/wge-server/service"
 	"wg-exchange/cmd/wge-server/terminator"
 	"wg-exchange/models"
 
@@ -18,10 +18,14 @@ import (
 
 var (
 	confFile    = flag.String("conf", cmd.DefaultServerTomlName, "server toml conf file")
-	enableDbus  = flag.Bool("dbus", false, "enable dbus systemd management")
+	serviceMgr  = flag.String("service-manager", "", fmt.Sprintf("interface service manager, one of %v (default from conf, otherwise %s)", service.Backends, service.DefaultBackend))
+	netlink     = flag.Bool("netlink", false, "apply peer changes to the running interface through netlink instead of restarting the service")
 	tlsCertPath = flag.String("cert", "server.pem", "tls server cert file, the first cert will be taken as the server cert. Any CAs in here will be considered in addition to the system CAs.")
 	tlsKeyPath  = flag.String("key", "server.key", "tls server key file")
 	listenAddr  = flag.String("listen", "127.0.0.1:7777", "address:port to listen on")
+	wgKeyPath   = flag.String("wg-key", "", "wireguard private key file, generated if missing (default /etc/wireguard/<InterfaceName>.key)")
+	rotateWgKey = flag.Bool("rotate-wg-key", false, "generate a new wireguard private key, overwriting the key file")
+	mergeConf   = flag.Bool("merge", false, "keep the peers of an existing interface conf instead of truncating it")
 	version     = flag.Bool("version", false, "version")
 )
 
@@ -38,8 +42,42 @@ func main() {
 	if _, err := toml.DecodeFile(*confFile, &wgeConf); err != nil {
 		log.Fatalln("invalid toml conf file", err)
 	}
+	if *serviceMgr != "" {
+		wgeConf.Server.ServiceManager = *serviceMgr
+	}
+	if wgeConf.Server.ServiceManager == "" {
+		wgeConf.Server.ServiceManager = service.DefaultBackend
+	}
+	if *netlink {
+		wgeConf.Server.Netlink = true
+	}
+	if *mergeConf {
+		wgeConf.Server.MergeConf = true
+	}
+	if *wgKeyPath != "" {
+		wgeConf.Server.KeyFile = *wgKeyPath
+	}
+
+	// history [list | diff <a> <b> | rollback <version>], doesn't start the server
+	if flag.Arg(0) == "history" {
+		if err := processor.RunHistory(wgeConf, flag.Args()[1:], os.Stdout); err != nil {
+			log.Println("history failure...", err)
+		}
+		return
+	}
+
+	if *rotateWgKey {
+		// the kept key would have to match the key file, which is exactly what changes
+		if wgeConf.Server.MergeConf && wgeConf.Server.MergeKeepKey {
+			log.Println("wireguard key rotation failure... disable MergeKeepPrivateKey to rotate the key of a merged conf")
+			return
+		}
+		if err := processor.RotateKeyFile(wgeConf.Server); err != nil {
+			log.Println("wireguard key rotation failure...", err)
+			return
+		}
+	}
 
-	dbusclient.DefaultSystemdManager.SetDbusSystemdManager(*enableDbus)
 	store, err := processor.NewStore(wgeConf)
 	if err != nil {
 		log.Println("processor init failure...", err)
@@ -0,0 +1,66 @@
+package netlinkclient
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// RTM_DELLINK over route netlink, what `ip link del` does. A missing link is not an error.
+func DeleteLink(name string) error {
+	ifi, err := net.InterfaceByName(name)
+	if err != nil {
+		// net doesn't export a not found error, an existing link is always found by name
+		return nil
+	}
+
+	fd, err := unix.Socket(unix.AF_NETLINK, unix.SOCK_RAW|unix.SOCK_CLOEXEC, unix.NETLINK_ROUTE)
+	if err != nil {
+		return err
+	}
+	defer unix.Close(fd)
+	if err := unix.Bind(fd, &unix.SockaddrNetlink{Family: unix.AF_NETLINK}); err != nil {
+		return err
+	}
+
+	const seq = 1
+	msg := make([]byte, unix.NLMSG_HDRLEN+unix.SizeofIfInfomsg)
+	binary.NativeEndian.PutUint32(msg[0:4], uint32(len(msg)))
+	binary.NativeEndian.PutUint16(msg[4:6], unix.RTM_DELLINK)
+	binary.NativeEndian.PutUint16(msg[6:8], unix.NLM_F_REQUEST|unix.NLM_F_ACK)
+	binary.NativeEndian.PutUint32(msg[8:12], seq)
+	// ifinfomsg, family unspec and everything but the index left zero
+	binary.NativeEndian.PutUint32(msg[unix.NLMSG_HDRLEN+4:unix.NLMSG_HDRLEN+8], uint32(ifi.Index))
+
+	if err := unix.Sendto(fd, msg, 0, &unix.SockaddrNetlink{Family: unix.AF_NETLINK}); err != nil {
+		return err
+	}
+
+	buf := make([]byte, recvBufLen)
+	for {
+		n, _, err := unix.Recvfrom(fd, buf, 0)
+		if err != nil {
+			return err
+		}
+		msgs, err := syscall.ParseNetlinkMessage(buf[:n])
+		if err != nil {
+			return err
+		}
+		for _, val := range msgs {
+			if val.Header.Seq != seq || val.Header.Type != unix.NLMSG_ERROR {
+				continue
+			}
+			if len(val.Data) < 4 {
+				return errors.New("truncated netlink error")
+			}
+			// gone in the meantime is fine too
+			if errno := unix.Errno(-int32(binary.NativeEndian.Uint32(val.Data[:4]))); errno != 0 && errno != unix.ENODEV {
+				return errno
+			}
+			return nil
+		}
+	}
+}
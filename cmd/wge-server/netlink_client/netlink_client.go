@@ -0,0 +1,237 @@
+// wireguard generic netlink, just enough of it to add and remove peers on a running device
+package netlinkclient
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net/netip"
+	"sync"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// refer: https://git.zx2c4.com/wireguard-linux/tree/include/uapi/linux/wireguard.h
+
+const (
+	genlHeaderLen = 4
+	recvBufLen    = 1 << 16
+	// ctrl and wireguard genl families are both at version 1
+	genlVersion = unix.WG_GENL_VERSION
+)
+
+type PeerConfig struct {
+	PublicKey    []byte
+	PresharedKey []byte
+	AllowedIPs   []netip.Prefix
+	// removes the peer, everything except the PublicKey is ignored
+	Remove bool
+}
+
+// What the processor needs from netlink, faked in tests
+type Client interface {
+	ConfigurePeers(device string, peers []PeerConfig) error
+	Close() error
+}
+
+type WireguardClient struct {
+	m      sync.Mutex
+	fd     int
+	seq    uint32
+	family uint16
+}
+
+func New() (*WireguardClient, error) {
+	fd, err := unix.Socket(unix.AF_NETLINK, unix.SOCK_RAW|unix.SOCK_CLOEXEC, unix.NETLINK_GENERIC)
+	if err != nil {
+		return nil, err
+	}
+	if err := unix.Bind(fd, &unix.SockaddrNetlink{Family: unix.AF_NETLINK}); err != nil {
+		unix.Close(fd)
+		return nil, err
+	}
+
+	c := &WireguardClient{fd: fd}
+	if c.family, err = c.resolveFamily(unix.WG_GENL_NAME); err != nil {
+		unix.Close(fd)
+		return nil, fmt.Errorf("wireguard genl family unavailable: %w", err)
+	}
+	return c, nil
+}
+
+func (c *WireguardClient) Close() error {
+	c.m.Lock()
+	defer c.m.Unlock()
+	return unix.Close(c.fd)
+}
+
+// One message per peer, keeps every message well under the socket buffer no matter how many allowed ips
+func (c *WireguardClient) ConfigurePeers(device string, peers []PeerConfig) error {
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	for _, val := range peers {
+		if len(val.PublicKey) != 32 {
+			return errors.New("invalid public key length")
+		}
+		var peer attrs
+		peer.add(unix.WGPEER_A_PUBLIC_KEY, val.PublicKey)
+		if val.Remove {
+			peer.addUint32(unix.WGPEER_A_FLAGS, unix.WGPEER_F_REMOVE_ME)
+		} else {
+			peer.addUint32(unix.WGPEER_A_FLAGS, unix.WGPEER_F_REPLACE_ALLOWEDIPS)
+			if len(val.PresharedKey) != 0 {
+				peer.add(unix.WGPEER_A_PRESHARED_KEY, val.PresharedKey)
+			}
+			var ips attrs
+			for _, ip := range val.AllowedIPs {
+				var allowed attrs
+				if ip.Addr().Is4() {
+					allowed.addUint16(unix.WGALLOWEDIP_A_FAMILY, unix.AF_INET)
+				} else {
+					allowed.addUint16(unix.WGALLOWEDIP_A_FAMILY, unix.AF_INET6)
+				}
+				allowed.add(unix.WGALLOWEDIP_A_IPADDR, ip.Masked().Addr().AsSlice())
+				allowed.add(unix.WGALLOWEDIP_A_CIDR_MASK, []byte{byte(ip.Bits())})
+				ips.addNested(0, allowed)
+			}
+			peer.addNested(unix.WGPEER_A_ALLOWEDIPS, ips)
+		}
+
+		var peerList, dev attrs
+		peerList.addNested(0, peer)
+		dev.addString(unix.WGDEVICE_A_IFNAME, device)
+		dev.addNested(unix.WGDEVICE_A_PEERS, peerList)
+
+		if _, err := c.execute(c.family, unix.WG_CMD_SET_DEVICE, dev); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *WireguardClient) resolveFamily(name string) (uint16, error) {
+	var req attrs
+	req.addString(unix.CTRL_ATTR_FAMILY_NAME, name)
+	resp, err := c.execute(unix.GENL_ID_CTRL, unix.CTRL_CMD_GETFAMILY, req)
+	if err != nil {
+		return 0, err
+	}
+	for _, msg := range resp {
+		if len(msg) < genlHeaderLen {
+			continue
+		}
+		for typ, val := range parseAttrs(msg[genlHeaderLen:]) {
+			if typ == unix.CTRL_ATTR_FAMILY_ID && len(val) == 2 {
+				return binary.NativeEndian.Uint16(val), nil
+			}
+		}
+	}
+	return 0, errors.New("family id missing in response")
+}
+
+// sends a single request and collects the payloads until the ack
+func (c *WireguardClient) execute(family uint16, cmd uint8, body attrs) ([][]byte, error) {
+	c.seq += 1
+	seq := c.seq
+
+	msg := make([]byte, unix.NLMSG_HDRLEN+genlHeaderLen, unix.NLMSG_HDRLEN+genlHeaderLen+len(body))
+	binary.NativeEndian.PutUint16(msg[4:6], family)
+	binary.NativeEndian.PutUint16(msg[6:8], unix.NLM_F_REQUEST|unix.NLM_F_ACK)
+	binary.NativeEndian.PutUint32(msg[8:12], seq)
+	msg[unix.NLMSG_HDRLEN] = cmd
+	msg[unix.NLMSG_HDRLEN+1] = genlVersion
+	msg = append(msg, body...)
+	binary.NativeEndian.PutUint32(msg[0:4], uint32(len(msg)))
+
+	if err := unix.Sendto(c.fd, msg, 0, &unix.SockaddrNetlink{Family: unix.AF_NETLINK}); err != nil {
+		return nil, err
+	}
+
+	var payloads [][]byte
+	buf := make([]byte, recvBufLen)
+	for {
+		n, _, err := unix.Recvfrom(c.fd, buf, 0)
+		if err != nil {
+			return nil, err
+		}
+		msgs, err := syscall.ParseNetlinkMessage(buf[:n])
+		if err != nil {
+			return nil, err
+		}
+		for _, val := range msgs {
+			if val.Header.Seq != seq {
+				continue
+			}
+			switch val.Header.Type {
+			case unix.NLMSG_ERROR:
+				if len(val.Data) < 4 {
+					return nil, errors.New("truncated netlink error")
+				}
+				// 0 is the ack, anything else is a negative errno
+				if errno := int32(binary.NativeEndian.Uint32(val.Data[:4])); errno != 0 {
+					return nil, unix.Errno(-errno)
+				}
+				return payloads, nil
+			case unix.NLMSG_DONE:
+				return payloads, nil
+			default:
+				// buf is reused by the next read
+				payloads = append(payloads, bytes.Clone(val.Data))
+			}
+		}
+	}
+}
+
+/** --- attributes --- */
+
+type attrs []byte
+
+func (a *attrs) add(typ uint16, val []byte) {
+	hdr := make([]byte, unix.SizeofNlAttr)
+	binary.NativeEndian.PutUint16(hdr[0:2], uint16(unix.SizeofNlAttr+len(val)))
+	binary.NativeEndian.PutUint16(hdr[2:4], typ)
+	*a = append(*a, hdr...)
+	*a = append(*a, val...)
+	// pad to NLA_ALIGNTO
+	for len(*a)%unix.NLMSG_ALIGNTO != 0 {
+		*a = append(*a, 0)
+	}
+}
+
+func (a *attrs) addNested(typ uint16, nested attrs) {
+	a.add(typ|unix.NLA_F_NESTED, nested)
+}
+
+func (a *attrs) addString(typ uint16, val string) {
+	a.add(typ, append([]byte(val), 0))
+}
+
+func (a *attrs) addUint16(typ uint16, val uint16) {
+	a.add(typ, binary.NativeEndian.AppendUint16(nil, val))
+}
+
+func (a *attrs) addUint32(typ uint16, val uint32) {
+	a.add(typ, binary.NativeEndian.AppendUint32(nil, val))
+}
+
+// top level attributes only, nested ones are left as is
+func parseAttrs(buf []byte) map[uint16][]byte {
+	parsed := make(map[uint16][]byte)
+	for len(buf) >= unix.SizeofNlAttr {
+		l := int(binary.NativeEndian.Uint16(buf[0:2]))
+		typ := binary.NativeEndian.Uint16(buf[2:4]) &^ unix.NLA_F_NESTED
+		if l < unix.SizeofNlAttr || l > len(buf) {
+			break
+		}
+		parsed[typ] = buf[unix.SizeofNlAttr:l]
+		aligned := (l + unix.NLMSG_ALIGNTO - 1) &^ (unix.NLMSG_ALIGNTO - 1)
+		if aligned > len(buf) {
+			break
+		}
+		buf = buf[aligned:]
+	}
+	return parsed
+}
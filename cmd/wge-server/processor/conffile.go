@@ -0,0 +1,181 @@
+package processor
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"os/user"
+	"path"
+	"strconv"
+	"strings"
+
+	"wg-exchange/cmd/wge-server/service"
+	"wg-exchange/models"
+)
+
+const (
+	confFileMode = 0o640
+	networkdPath = "/etc/systemd/network/"
+	// networkd reads its files as this group
+	networkdGroup = "systemd-network"
+
+	DefaultConfBackups = 3
+)
+
+// WireguardPath, otherwise wherever the service manager expects the conf
+func confDir(servConf models.WGEServer) string {
+	if servConf.WireguardPath != "" {
+		return servConf.WireguardPath
+	}
+	if servConf.ServiceManager == service.BackendNetworkd {
+		return networkdPath
+	}
+	return defaultWireguardPath
+}
+
+// the wg-quick conf, networkd reads the .netdev/.network next to where it would be instead
+func confFilePath(servConf models.WGEServer) string {
+	return path.Join(confDir(servConf), fmt.Sprintf("%s.conf", servConf.IntrfcName))
+}
+
+func networkdFilePaths(confPath string) (netdev string, network string) {
+	base := strings.TrimSuffix(confPath, ".conf")
+	return base + ".netdev", base + ".network"
+}
+
+// group readable only, the .netdev has the private key
+func chownNetworkd(paths ...string) error {
+	grp, err := user.LookupGroup(networkdGroup)
+	if err != nil {
+		return err
+	}
+	gid, err := strconv.Atoi(grp.Gid)
+	if err != nil {
+		return err
+	}
+	for _, val := range paths {
+		if err := os.Chown(val, -1, gid); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// The conf as the service manager reads it, a wg-quick conf or a networkd .netdev/.network pair.
+// Either way it's written atomically with its own backups.
+func writeInterfaceConf(confPath string, intrfc string, conf models.ServerConfig, networkd bool, keep int) error {
+	if !networkd {
+		buf, err := conf.MarshalText()
+		if err != nil {
+			return err
+		}
+		return writeConfAtomic(confPath, buf, keep)
+	}
+
+	netdev, network, warnings, err := conf.MarshalNetworkd(intrfc)
+	for _, val := range warnings {
+		log.Println("warning for the networkd conf...", val)
+	}
+	if err != nil {
+		return err
+	}
+	netdevPath, networkPath := networkdFilePaths(confPath)
+	// .network first, a .netdev without it is a device with no addresses
+	if err := writeConfAtomic(networkPath, network, keep); err != nil {
+		return err
+	}
+	if err := writeConfAtomic(netdevPath, netdev, keep); err != nil {
+		return err
+	}
+	return chownNetworkd(networkPath, netdevPath)
+}
+
+// held by whoever is writing the conf, the running server or a history rollback
+func lockFilePath(intrfc string) string {
+	return path.Join(os.TempDir(), fmt.Sprintf(".wge-%s", intrfc))
+}
+
+func confBackups(servConf models.WGEServer) int {
+	if servConf.ConfBackups == 0 {
+		return DefaultConfBackups
+	}
+	return servConf.ConfBackups
+}
+
+// <conf>.1 is the newest backup
+func backupPath(confPath string, n int) string {
+	return fmt.Sprintf("%s.%d", confPath, n)
+}
+
+// shifts the backups up by one, dropping the oldest, and hard links the current conf as <conf>.1
+func rotateBackups(confPath string, keep int) error {
+	if keep <= 0 {
+		return nil
+	}
+	if _, err := os.Stat(confPath); errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+
+	if err := os.Remove(backupPath(confPath, keep)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	for i := keep - 1; i >= 1; i-- {
+		if err := os.Rename(backupPath(confPath, i), backupPath(confPath, i+1)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+	}
+	return os.Link(confPath, backupPath(confPath, 1))
+}
+
+// the directory entry of the rename isn't durable until the directory itself is synced
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// Written to a temp file next to the conf, fsynced and renamed over it.
+// A crash or a full disk leaves either the old or the new conf, never half of one.
+func writeConfAtomic(confPath string, buf []byte, keep int) error {
+	// unchanged, not worth a backup
+	if prev, err := os.ReadFile(confPath); err == nil && bytes.Equal(prev, buf) {
+		return nil
+	}
+
+	dir := path.Dir(confPath)
+	f, err := os.CreateTemp(dir, fmt.Sprintf(".%s-*", path.Base(confPath)))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	if err := f.Chmod(confFileMode); err != nil {
+		f.Close()
+		return err
+	}
+	if _, err := f.Write(buf); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	if err := rotateBackups(confPath, keep); err != nil {
+		return fmt.Errorf("failure rotating conf backups: %w", err)
+	}
+	if err := os.Rename(f.Name(), confPath); err != nil {
+		return err
+	}
+	return syncDir(dir)
+}
@@ -0,0 +1,425 @@
+package processor
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"net"
+	"os"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"wg-exchange/cmd/wge-server/service"
+	"wg-exchange/models"
+
+	"github.com/gofrs/flock"
+)
+
+const (
+	historyDirFormat  = "%s.history"
+	historyFileFormat = "%06d.json"
+	historyFileExt    = ".json"
+
+	DefaultHistoryVersions = 20
+
+	changeEnroll = "enroll"
+	changeRevoke = "revoke"
+)
+
+// who enrolled or revoked what
+type historyChange struct {
+	Action     string     `json:"action"`
+	Name       string     `json:"name,omitempty"`
+	Pub        models.Key `json:"publicKey"`
+	Subject    string     `json:"subject,omitempty"`
+	RemoteAddr string     `json:"remoteAddr,omitempty"`
+	Time       time.Time  `json:"time"`
+}
+
+// The conf as written and the state of the peers in it, after a batch was applied
+type snapshot struct {
+	Version int             `json:"version"`
+	Time    time.Time       `json:"time"`
+	Note    string          `json:"note,omitempty"`
+	Changes []historyChange `json:"changes,omitempty"`
+	Peers   []peerRecord    `json:"peers"`
+	Conf    string          `json:"conf"`
+}
+
+func historyDirPath(servConf models.WGEServer) string {
+	if servConf.HistoryDir != "" {
+		return servConf.HistoryDir
+	}
+	return path.Join(defaultStatePath, fmt.Sprintf(historyDirFormat, servConf.IntrfcName))
+}
+
+// every snapshot has the whole conf and all of the peers, so only the latest few are kept
+func historyVersionsKept(servConf models.WGEServer) int {
+	if servConf.HistoryVersions == 0 {
+		return DefaultHistoryVersions
+	}
+	return servConf.HistoryVersions
+}
+
+func (e procEntry) change() historyChange {
+	action := changeEnroll
+	if e.revoke {
+		action = changeRevoke
+	}
+	return historyChange{
+		Action:     action,
+		Name:       e.name,
+		Pub:        e.creds.Pub,
+		Subject:    e.req.Subject,
+		RemoteAddr: e.req.RemoteAddr,
+		Time:       time.Now().UTC(),
+	}
+}
+
+// ascending, missing dir is just an empty history
+func historyVersions(dir string) ([]int, error) {
+	entries, err := os.ReadDir(dir)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	versions := make([]int, 0, len(entries))
+	for _, val := range entries {
+		name, ok := strings.CutSuffix(val.Name(), historyFileExt)
+		if !ok || val.IsDir() {
+			continue
+		}
+		if version, err := strconv.Atoi(name); err == nil {
+			versions = append(versions, version)
+		}
+	}
+	slices.Sort(versions)
+	return versions, nil
+}
+
+func loadSnapshot(dir string, version int) (*snapshot, error) {
+	buf, err := os.ReadFile(path.Join(dir, fmt.Sprintf(historyFileFormat, version)))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, fmt.Errorf("no version %d in history", version)
+	} else if err != nil {
+		return nil, err
+	}
+
+	var snap snapshot
+	if err := json.Unmarshal(buf, &snap); err != nil {
+		return nil, err
+	}
+	return &snap, nil
+}
+
+// Numbered after the latest one, an unchanged conf without changes or note isn't worth a version
+func saveSnapshot(dir string, snap *snapshot) error {
+	versions, err := historyVersions(dir)
+	if err != nil {
+		return err
+	}
+	if len(versions) != 0 {
+		latest, err := loadSnapshot(dir, versions[len(versions)-1])
+		if err != nil {
+			return err
+		}
+		if latest.Conf == snap.Conf && len(snap.Changes) == 0 && snap.Note == "" {
+			return nil
+		}
+		snap.Version = latest.Version + 1
+	} else {
+		snap.Version = 1
+	}
+
+	buf, err := json.MarshalIndent(snap, "", "  ")
+	if err != nil {
+		return err
+	}
+	// keys in both the conf and the state, same as the state file
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(dir, ".snapshot-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	if _, err := f.Write(buf); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path.Join(dir, fmt.Sprintf(historyFileFormat, snap.Version)))
+}
+
+// drops all but the newest keep versions, negative keeps everything
+func pruneHistory(dir string, keep int) error {
+	if keep < 0 {
+		return nil
+	}
+	versions, err := historyVersions(dir)
+	if err != nil || len(versions) <= keep {
+		return err
+	}
+	for _, version := range versions[:len(versions)-keep] {
+		if err := os.Remove(path.Join(dir, fmt.Sprintf(historyFileFormat, version))); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+	}
+	return nil
+}
+
+// state records of the peers that made it into the conf
+func peersInConf(records []peerRecord, conf models.ServerConfig) []peerRecord {
+	return slices.DeleteFunc(records, func(r peerRecord) bool {
+		return !slices.ContainsFunc(conf.Peer, func(peer models.Peer) bool { return bytes.Equal(peer.Pub, r.Pub) })
+	})
+}
+
+// a failing snapshot doesn't stop the interface, it's only logged
+func (p *Processor) recordHistory(note string) {
+	if p.historyDir == "" {
+		return
+	}
+	buf, err := p.servConf.MarshalText()
+	if err != nil {
+		log.Println("failure writing history snapshot...", err)
+		return
+	}
+	records, err := loadState(p.statePath)
+	if err != nil {
+		log.Println("failure writing history snapshot...", err)
+		return
+	}
+
+	snap := &snapshot{
+		Time:    time.Now().UTC(),
+		Note:    note,
+		Changes: p.changes,
+		Peers:   peersInConf(records, p.servConf),
+		Conf:    string(buf),
+	}
+	if err := saveSnapshot(p.historyDir, snap); err != nil {
+		log.Println("failure writing history snapshot...", err)
+		return
+	}
+	p.changes = nil
+	if err := pruneHistory(p.historyDir, p.historyKeep); err != nil {
+		log.Println("failure pruning history...", err)
+	}
+}
+
+/** --- history command --- */
+
+// wge-server history [list | diff <a> <b> | rollback <version>]
+func RunHistory(servConf models.WGEServerConf, args []string, w io.Writer) error {
+	dir := historyDirPath(servConf.Server)
+	if len(args) == 0 {
+		args = []string{"list"}
+	}
+
+	versions := make([]int, 0, 2)
+	for _, val := range args[1:] {
+		version, err := strconv.Atoi(val)
+		if err != nil {
+			return fmt.Errorf("invalid version %q", val)
+		}
+		versions = append(versions, version)
+	}
+
+	switch {
+	case args[0] == "list" && len(versions) == 0:
+		return listHistory(dir, w)
+	case args[0] == "diff" && len(versions) == 2:
+		return diffHistory(dir, versions[0], versions[1], w)
+	case args[0] == "rollback" && len(versions) == 1:
+		return rollbackHistory(servConf, dir, versions[0])
+	default:
+		return errors.New("expected list, diff <version> <version> or rollback <version>")
+	}
+}
+
+func describeChanges(changes []historyChange) string {
+	described := make([]string, 0, len(changes))
+	for _, val := range changes {
+		sign := "+"
+		if val.Action == changeRevoke {
+			sign = "-"
+		}
+		name := val.Name
+		if name == "" {
+			name = base64.StdEncoding.EncodeToString(val.Pub)
+		}
+		described = append(described, fmt.Sprintf("%s%s by %s", sign, name, val.Subject))
+	}
+	return strings.Join(described, ", ")
+}
+
+func listHistory(dir string, w io.Writer) error {
+	versions, err := historyVersions(dir)
+	if err != nil {
+		return err
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "VERSION\tTIME\tPEERS\tCHANGES\tNOTE")
+	for _, version := range versions {
+		snap, err := loadSnapshot(dir, version)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(tw, "%d\t%s\t%d\t%s\t%s\n",
+			snap.Version,
+			snap.Time.Local().Format(time.DateTime),
+			len(snap.Peers),
+			describeChanges(snap.Changes),
+			snap.Note,
+		)
+	}
+	return tw.Flush()
+}
+
+// longest common subsequence, confs are small enough for the quadratic table
+func diffLines(a []string, b []string) []string {
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else {
+				lcs[i][j] = max(lcs[i+1][j], lcs[i][j+1])
+			}
+		}
+	}
+
+	diff := make([]string, 0, len(a)+len(b))
+	i, j := 0, 0
+	for i < len(a) || j < len(b) {
+		switch {
+		case i < len(a) && j < len(b) && a[i] == b[j]:
+			diff = append(diff, " "+a[i])
+			i, j = i+1, j+1
+		case i < len(a) && (j == len(b) || lcs[i+1][j] >= lcs[i][j+1]):
+			diff = append(diff, "-"+a[i])
+			i += 1
+		default:
+			diff = append(diff, "+"+b[j])
+			j += 1
+		}
+	}
+	return diff
+}
+
+func diffHistory(dir string, from int, to int, w io.Writer) error {
+	a, err := loadSnapshot(dir, from)
+	if err != nil {
+		return err
+	}
+	b, err := loadSnapshot(dir, to)
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(w, "--- version %d (%s)\n", a.Version, a.Time.Local().Format(time.DateTime))
+	fmt.Fprintf(w, "+++ version %d (%s)\n", b.Version, b.Time.Local().Format(time.DateTime))
+	lines := func(conf string) []string { return strings.Split(strings.TrimRight(conf, "\n"), "\n") }
+	for _, line := range diffLines(lines(a.Conf), lines(b.Conf)) {
+		fmt.Fprintln(w, line)
+	}
+
+	// who the differing peers were enrolled by, the conf only has their keys
+	for _, val := range a.Peers {
+		if !slices.ContainsFunc(b.Peers, func(r peerRecord) bool { return bytes.Equal(r.Pub, val.Pub) }) {
+			fmt.Fprintf(w, "peer removed: %s %s, enrolled %s by %s\n", val.Name, base64.StdEncoding.EncodeToString(val.Pub), val.Enrolled.Local().Format(time.DateTime), val.Subject)
+		}
+	}
+	for _, val := range b.Peers {
+		if !slices.ContainsFunc(a.Peers, func(r peerRecord) bool { return bytes.Equal(r.Pub, val.Pub) }) {
+			fmt.Fprintf(w, "peer added: %s %s, enrolled %s by %s\n", val.Name, base64.StdEncoding.EncodeToString(val.Pub), val.Enrolled.Local().Format(time.DateTime), val.Subject)
+		}
+	}
+	return nil
+}
+
+// Writes back the conf and the state of the version and re-applies it, the server has to be stopped.
+// The rollback itself becomes the newest version.
+func rollbackHistory(servConf models.WGEServerConf, dir string, version int) error {
+	snap, err := loadSnapshot(dir, version)
+	if err != nil {
+		return err
+	}
+
+	intrfc := servConf.Server.IntrfcName
+	if intrfc == "" {
+		return errors.New("invalid device name")
+	}
+	fLock := flock.New(lockFilePath(intrfc))
+	if ok, err := fLock.TryLock(); err != nil || !ok {
+		return fmt.Errorf("server is running, stop it before rolling back: %v", err)
+	}
+	defer fLock.Unlock()
+
+	manager, err := service.New(servConf.Server.ServiceManager, service.Options{
+		RuntimeEnable: servConf.Server.RuntimeEnable,
+		ConfDir:       confDir(servConf.Server),
+	})
+	if err != nil {
+		return err
+	}
+
+	// state first, the next server start regenerates the conf from it
+	if err := saveState(stateFilePath(servConf.Server), snap.Peers); err != nil {
+		return err
+	}
+	// kept as a wg-quick conf, networkd gets it rendered as its own files
+	var conf models.ServerConfig
+	if err := conf.UnmarshalText([]byte(snap.Conf)); err != nil {
+		return err
+	}
+	networkd := servConf.Server.ServiceManager == service.BackendNetworkd
+	if err := writeInterfaceConf(confFilePath(servConf.Server), intrfc, conf, networkd, confBackups(servConf.Server)); err != nil {
+		return err
+	}
+	// a running interface has to be restarted, starting doesn't reload the conf with every backend
+	if _, err := net.InterfaceByName(intrfc); err == nil {
+		err = manager.RestartService(intrfc)
+	} else {
+		err = manager.EnableAndStartService(intrfc)
+	}
+	if err != nil {
+		return err
+	}
+	log.Println("rolled back to version:", version)
+
+	err = saveSnapshot(dir, &snapshot{
+		Time:  time.Now().UTC(),
+		Note:  fmt.Sprintf("rollback to version %d", version),
+		Peers: snap.Peers,
+		Conf:  snap.Conf,
+	})
+	if err != nil {
+		return err
+	}
+	return pruneHistory(dir, historyVersionsKept(servConf.Server))
+}
@@ -0,0 +1,120 @@
+package processor
+
+import (
+	"bytes"
+	"crypto/ecdh"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path"
+
+	"wg-exchange/models"
+)
+
+const keyFileMode = 0o600
+
+func keyFilePath(servConf models.WGEServer) string {
+	if servConf.KeyFile != "" {
+		return servConf.KeyFile
+	}
+	return path.Join(confDir(servConf), fmt.Sprintf("%s.key", servConf.IntrfcName))
+}
+
+// same format as `wg genkey`, base64 of the raw key on a single line
+func readKeyFile(keyPath string) (*ecdh.PrivateKey, error) {
+	buf, err := os.ReadFile(keyPath)
+	if err != nil {
+		return nil, err
+	}
+	if fstat, err := os.Stat(keyPath); err == nil && fstat.Mode().Perm()&0o077 != 0 {
+		log.Println("wireguard key file is accessible by others, mode:", fstat.Mode().Perm())
+	}
+
+	raw, err := base64.StdEncoding.DecodeString(string(bytes.TrimSpace(buf)))
+	if err != nil {
+		return nil, fmt.Errorf("invalid wireguard key file: %w", err)
+	}
+	return ecdh.X25519().NewPrivateKey(raw)
+}
+
+// written next to the target and renamed over, never truncates an existing key in place
+func writeKeyFile(keyPath string, priv *ecdh.PrivateKey) error {
+	f, err := os.CreateTemp(path.Dir(keyPath), fmt.Sprintf(".%s-*", path.Base(keyPath)))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	if err := f.Chmod(keyFileMode); err != nil {
+		f.Close()
+		return err
+	}
+	if _, err := fmt.Fprintln(f, base64.StdEncoding.EncodeToString(priv.Bytes())); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), keyPath)
+}
+
+func loadOrCreateKey(keyPath string) (*ecdh.PrivateKey, error) {
+	priv, err := readKeyFile(keyPath)
+	if err == nil {
+		log.Println("loaded wireguard key:", keyPath)
+		return priv, nil
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+
+	if priv, err = ecdh.X25519().GenerateKey(rand.Reader); err != nil {
+		return nil, err
+	}
+	if err := writeKeyFile(keyPath, priv); err != nil {
+		return nil, err
+	}
+	log.Println("generated new wireguard key:", keyPath)
+	return priv, nil
+}
+
+// The key of a merged conf becomes the key file, so that starts without merging keep the same public key.
+// A key file with another key is refused, only a rotation replaces the key.
+func keepKeyFile(keyPath string, priv *ecdh.PrivateKey) error {
+	existing, err := readKeyFile(keyPath)
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+		if err := writeKeyFile(keyPath, priv); err != nil {
+			return err
+		}
+		log.Println("wrote private key of existing conf to:", keyPath)
+		return nil
+	case err != nil:
+		return err
+	case !existing.Equal(priv):
+		return fmt.Errorf("wireguard key file %s doesn't match the private key of the existing conf, remove one of them or disable MergeKeepPrivateKey", keyPath)
+	}
+	return nil
+}
+
+// Only way the server key changes, every previously issued client conf needs the new public key after this
+func RotateKeyFile(servConf models.WGEServer) error {
+	keyPath := keyFilePath(servConf)
+	priv, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return err
+	}
+	if err := writeKeyFile(keyPath, priv); err != nil {
+		return err
+	}
+	log.Println("rotated wireguard key:", keyPath, ", public key:", base64.StdEncoding.EncodeToString(priv.PublicKey().Bytes()))
+	return nil
+}
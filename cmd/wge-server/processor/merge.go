@@ -0,0 +1,103 @@
+package processor
+
+import (
+	"crypto/ecdh"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"net/netip"
+	"os"
+	"slices"
+
+	"wg-exchange/cmd/wge-server/ipam"
+	"wg-exchange/models"
+)
+
+// existing interface conf, nil if there is none yet
+func readExistingConf(confPath string) (*models.ServerConfig, error) {
+	buf, err := os.ReadFile(confPath)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var conf models.ServerConfig
+	if err := conf.UnmarshalText(buf); err != nil {
+		return nil, fmt.Errorf("invalid existing conf %s: %w", confPath, err)
+	}
+	return &conf, nil
+}
+
+// Hand managed peers are kept as they are, their keys and addresses are taken out of circulation.
+// They aren't persisted in the state, the conf itself is their source.
+// Peers already restored from the state are skipped.
+func (s *Store) importPeers(peers []models.Peer) error {
+	// hand managed peers often sit in ReservedIPs, which the pools never had, so only other peers collide with those
+	taken := make(map[netip.Addr]bool)
+	for _, val := range s.records {
+		addrs, _ := peerAddrs(val.Address)
+		for _, addr := range addrs {
+			taken[addr] = true
+		}
+	}
+	for _, val := range s.imported {
+		for _, ip := range val.Address {
+			if prefix, err := netip.ParsePrefix(ip); err == nil && prefix.IsSingleIP() {
+				taken[prefix.Addr()] = true
+			}
+		}
+	}
+
+	imported := make([]*ecdh.PublicKey, 0, len(peers))
+	for _, val := range peers {
+		pub, err := ecdh.X25519().NewPublicKey(val.Pub)
+		if err != nil {
+			return fmt.Errorf("invalid public key in existing conf: %w", err)
+		}
+		if _, ok := slices.BinarySearchFunc(s.pubKeys, pub, cmp); ok {
+			continue
+		}
+		if slices.ContainsFunc(imported, func(k *ecdh.PublicKey) bool { return k.Equal(pub) }) {
+			return errors.New("duplicate public key in existing conf")
+		}
+
+		for _, ip := range val.Ips {
+			prefix, err := netip.ParsePrefix(ip)
+			if err != nil {
+				return fmt.Errorf("invalid allowed ips in existing conf: %w", err)
+			}
+			reserved := slices.ContainsFunc(s.reserved, func(r ipam.Range) bool { return r.Contains(prefix.Addr()) })
+			switch {
+			case !prefix.IsSingleIP():
+				s.ipam.ReservePrefix(prefix)
+			case reserved && taken[prefix.Addr()]:
+				return fmt.Errorf("address collision in existing conf: %s", prefix.Addr())
+			case reserved:
+				taken[prefix.Addr()] = true
+			default:
+				if err := s.ipam.Reserve(prefix.Addr()); err != nil && !errors.Is(err, ipam.ErrNotInPool) {
+					return fmt.Errorf("address collision in existing conf: %w", err)
+				}
+			}
+		}
+		imported = append(imported, pub)
+		s.processor.servConf.Peer = append(s.processor.servConf.Peer, val)
+
+		// without a wge: comment only the key and ips are known
+		meta, _ := val.Meta()
+		s.imported = append(s.imported, models.PeerInfo{
+			Name:      meta.Name,
+			PublicKey: val.Pub,
+			Address:   val.Ips,
+			Enrolled:  meta.Enrolled,
+			Subject:   meta.Cert,
+		})
+	}
+
+	s.pubKeys = append(s.pubKeys, imported...)
+	slices.SortFunc(s.pubKeys, cmp)
+	log.Println("imported peers from existing conf:", len(imported))
+	return nil
+}
@@ -0,0 +1,192 @@
+package processor
+
+import (
+	"fmt"
+	"net/netip"
+	"path"
+	"slices"
+
+	"wg-exchange/cmd/wge-server/ipam"
+	"wg-exchange/models"
+)
+
+const (
+	policyAllow = "allow"
+	policyDeny  = "deny"
+)
+
+// models.PolicyRule with everything parsed up front, a broken rule stops the server instead of every enrollment
+type policyRule struct {
+	models.PolicyRule
+	source []netip.Prefix
+	pool   []ipam.Range
+}
+
+func compilePolicy(rules []models.PolicyRule, netIps []netip.Prefix, routes map[string][]string) ([]policyRule, error) {
+	compiled := make([]policyRule, 0, len(rules))
+	for i, val := range rules {
+		rule := policyRule{PolicyRule: val}
+		if rule.Name == "" {
+			rule.Name = fmt.Sprintf("#%d", i+1)
+		}
+		invalid := func(format string, args ...any) error {
+			return fmt.Errorf("policy rule %s: %s", rule.Name, fmt.Sprintf(format, args...))
+		}
+
+		if rule.Action != policyAllow && rule.Action != policyDeny {
+			return nil, invalid("action has to be allow or deny, got %q", rule.Action)
+		}
+		for _, pattern := range slices.Concat(rule.CommonName, rule.Org, rule.OrgUnit, rule.SAN) {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return nil, invalid("invalid pattern %q", pattern)
+			}
+		}
+		for _, src := range rule.Source {
+			prefix, err := netip.ParsePrefix(src)
+			if err != nil {
+				return nil, invalid("invalid source %q", src)
+			}
+			rule.source = append(rule.source, prefix.Masked())
+		}
+		for _, pool := range rule.Pool {
+			r, err := ipam.ParseRange(pool)
+			if err != nil {
+				return nil, invalid("invalid pool %q", pool)
+			}
+			if !slices.ContainsFunc(netIps, func(p netip.Prefix) bool { return p.Contains(r.First) && p.Contains(r.Last) }) {
+				return nil, invalid("pool %q outside of the interface networks", pool)
+			}
+			rule.pool = append(rule.pool, r)
+		}
+		if _, err := models.SubtractAllowedIps(rule.AllowedIps, rule.ExcludeIps); err != nil {
+			return nil, invalid("%v", err)
+		}
+		for _, name := range rule.Routes {
+			if _, ok := routes[name]; !ok {
+				return nil, invalid("unknown route set %q", name)
+			}
+		}
+		for _, dns := range rule.Dns {
+			if _, err := netip.ParseAddr(dns); err != nil {
+				return nil, invalid("invalid dns %q", dns)
+			}
+		}
+		compiled = append(compiled, rule)
+	}
+	return compiled, nil
+}
+
+// full and vpn along with the sets of the server toml
+func compileRoutes(routes map[string][]string, netIps []netip.Prefix) (map[string][]string, error) {
+	vpn := make([]string, 0, len(netIps))
+	for _, val := range netIps {
+		vpn = append(vpn, val.Masked().String())
+	}
+	sets := map[string][]string{models.RoutesFull: DefaultAllowedIps[:], models.RoutesVPN: vpn}
+	for name, prefixes := range routes {
+		if _, ok := sets[name]; ok || name == "" {
+			return nil, fmt.Errorf("route set name %q is reserved", name)
+		}
+		if len(prefixes) == 0 {
+			return nil, fmt.Errorf("route set %s is empty", name)
+		}
+		for _, val := range prefixes {
+			if _, err := netip.ParsePrefix(val); err != nil {
+				return nil, fmt.Errorf("route set %s: invalid prefix %q", name, val)
+			}
+		}
+		sets[name] = prefixes
+	}
+	return sets, nil
+}
+
+// no patterns match anything, otherwise any pattern has to match any of the values
+func matchAny(patterns []string, values ...string) bool {
+	if len(patterns) == 0 {
+		return true
+	}
+	for _, pattern := range patterns {
+		for _, val := range values {
+			if ok, _ := path.Match(pattern, val); ok {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (r policyRule) matches(req Requester) bool {
+	if !matchAny(r.CommonName, req.CommonName) || !matchAny(r.Org, req.Org...) ||
+		!matchAny(r.OrgUnit, req.OrgUnit...) || !matchAny(r.SAN, req.SANs...) {
+		return false
+	}
+	if len(r.source) == 0 {
+		return true
+	}
+	src, err := netip.ParseAddrPort(req.RemoteAddr)
+	if err != nil {
+		return false
+	}
+	return slices.ContainsFunc(r.source, func(p netip.Prefix) bool { return p.Contains(src.Addr().Unmap()) })
+}
+
+// The first rule matching the request, nil if there are no rules at all
+func (s *Store) evaluatePolicy(req Requester) (*policyRule, error) {
+	if len(s.policy) == 0 {
+		return nil, nil
+	}
+	for i, val := range s.policy {
+		if !val.matches(req) {
+			continue
+		}
+		if val.Action == policyDeny {
+			return &s.policy[i], fmt.Errorf("%w by policy rule %s", ErrPolicyDenied, val.Name)
+		}
+		return &s.policy[i], nil
+	}
+	return nil, fmt.Errorf("%w, no policy rule matches", ErrPolicyDenied)
+}
+
+// AllowedIPs of the client's peer, less the rule's excludes. A requested route set has to be one the rule lets through,
+// without a request it's what the rule hands out, the full tunnel otherwise.
+func (s *Store) allowedIps(rule *policyRule, requested string) ([]string, error) {
+	ips := DefaultAllowedIps[:]
+	restricted := rule != nil && (len(rule.Routes) != 0 || len(rule.AllowedIps) != 0)
+	switch {
+	case requested != "":
+		var ok bool
+		if ips, ok = s.routes[requested]; !ok {
+			return nil, fmt.Errorf("unknown route set %q", requested)
+		}
+		if restricted && !slices.Contains(rule.Routes, requested) {
+			return nil, fmt.Errorf("%w, route set %s not allowed by policy rule %s", ErrPolicyDenied, requested, rule.Name)
+		}
+	case rule != nil && len(rule.AllowedIps) != 0:
+		ips = rule.AllowedIps
+	case rule != nil && len(rule.Routes) != 0:
+		ips = s.routes[rule.Routes[0]]
+	}
+
+	pushed := s.pushedSubnets()
+	if restricted {
+		// only what the rule grants anyway, pushing can't widen it
+		granted := appendPrefixes(nil, rule.AllowedIps)
+		for _, name := range rule.Routes {
+			granted = appendPrefixes(granted, s.routes[name])
+		}
+		pushed = slices.DeleteFunc(pushed, func(subnet string) bool {
+			prefix, err := netip.ParsePrefix(subnet)
+			return err != nil || !slices.ContainsFunc(granted, func(p netip.Prefix) bool { return p.Bits() <= prefix.Bits() && p.Contains(prefix.Addr()) })
+		})
+	}
+	if s.pushSubnets && len(pushed) != 0 {
+		var err error
+		if ips, err = models.SubtractAllowedIps(append(slices.Clone(ips), pushed...), nil); err != nil {
+			return nil, err
+		}
+	}
+	if rule == nil || len(rule.ExcludeIps) == 0 {
+		return ips, nil
+	}
+	return models.SubtractAllowedIps(ips, rule.ExcludeIps)
+}
@@ -1,21 +1,26 @@
 package processor
 
 import (
+	"bytes"
 	"context"
 	"crypto/ecdh"
-	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
 	"errors"
 	"fmt"
 	"log"
 	"net/netip"
-	"os"
-	"path"
 	"slices"
+	"strings"
 	"sync"
 	"time"
+	"unicode"
+	"unicode/utf8"
 
 	"wg-exchange/cmd"
-	dbusclient "wg-exchange/cmd/wge-server/dbus_client"
+	"wg-exchange/cmd/wge-server/ipam"
+	netlinkclient "wg-exchange/cmd/wge-server/netlink_client"
+	"wg-exchange/cmd/wge-server/service"
 	"wg-exchange/cmd/wge-server/terminator"
 	"wg-exchange/models"
 
@@ -23,28 +28,58 @@ import (
 )
 
 const (
-	wireguardPath = "/etc/wireguard/"
-	maxIPIncr     = (1 << 8) - 1 // just the last byte of the address
-	ipv6PeerMask  = 128
-	ipv4PeerMask  = 32
+	defaultWireguardPath = "/etc/wireguard/"
+	ipv6PeerMask         = 128
+	ipv4PeerMask         = 32
+	// optional peer names end up in logs, listings and the wge: comment of the peer
+	maxPeerNameLen = 255
 )
 
 var (
 	DefaultAllowedIps = [...]string{"0.0.0.0/0", "::/0"}
+
+	ErrPeerNotFound = errors.New("peer not found")
+	ErrForbidden    = errors.New("not allowed to revoke peer")
+	ErrOverQuota    = errors.New("peer quota exceeded")
+	ErrPolicyDenied = errors.New("enrollment denied")
 )
 
 type procEntry struct {
-	creds models.Credentials
-	ips   []string
+	creds  models.Credentials
+	ips    []string
+	revoke bool
+	// history and the wge: comment of the peer block
+	name     string
+	req      Requester
+	enrolled time.Time
+	// routed subnets, their routes only come with a restart of the interface
+	routed bool
+}
+
+// the subject is the one verified by the mTLS handshake, not anything the client claims
+func (e procEntry) meta() models.PeerMeta {
+	return models.PeerMeta{Name: e.name, Cert: e.req.Subject, Enrolled: e.enrolled}
 }
 
 // For quickly checking and dispatching clientconf back in response
 type Store struct {
 	sync.Mutex
-	pubKeys []*ecdh.PublicKey
+	pubKeys   []*ecdh.PublicKey
+	records   []peerRecord
+	statePath string
+	quotas    models.Quotas
+	policy    []policyRule
+	routes    map[string][]string
+	// allowlist of the subnets peers may have routed to them
+	routedSubnets []netip.Prefix
+	pushSubnets   bool
+	// peers of a merged conf, listed from their wge: comments
+	imported []models.PeerInfo
 
 	dns       []string
 	netIps    []netip.Prefix
+	ipam      *ipam.Allocator
+	reserved  []ipam.Range
 	pub       *ecdh.PublicKey
 	endpoint  string
 	processor *Processor
@@ -56,8 +91,24 @@ type Processor struct {
 	intrfc         string
 	path           string
 	fLock          *flock.Flock
-	systemdManager *dbusclient.SystemdManager
+	serviceManager service.Manager
+	onShutdown     string
 	servConf       models.ServerConfig
+	// .netdev/.network pair next to path instead of the wg-quick conf
+	networkd bool
+	// nil unless peers are applied live, the service is restarted otherwise
+	netlink netlinkclient.Client
+	// previous versions kept next to the conf
+	backups int
+	// peers of the last conf the service ran with, restored when a restart fails
+	goodPeers []models.Peer
+	// enrolled peers a rollback took out, put back in with the next batch
+	heldBack []models.Peer
+	// snapshots of every applied batch, always set by NewStore, only tests leave it empty
+	historyDir  string
+	historyKeep int
+	statePath   string
+	changes     []historyChange
 }
 
 /** --- Store --- */
@@ -76,44 +127,62 @@ func cmp(a *ecdh.PublicKey, b *ecdh.PublicKey) int {
 	return 0
 }
 
-func (s *Store) getNextIps(incr int) (clientAddress []string, serverPeerIps []string, err error) {
-	if incr > maxIPIncr {
-		return nil, nil, errors.New("max peers reached")
+// next free host address of every interface prefix, as client interface addresses and server side peer routes.
+// A policy pool limits the prefixes it falls in to its ranges.
+func (s *Store) getNextIps(pool []ipam.Range) (clientAddress []string, serverPeerIps []string, err error) {
+	addrs, err := s.ipam.AllocateWithin(pool)
+	if err != nil {
+		return nil, nil, err
 	}
 
-	for _, val := range s.netIps {
-		tmp := val.Addr().AsSlice()
-
-		// increment
-		tmp[len(tmp)-1] += byte(incr)
-		tmpAddr, ok := netip.AddrFromSlice(tmp)
-
-		if ok && val.Contains(tmpAddr) {
-			c := netip.PrefixFrom(tmpAddr, val.Bits())
-
-			var s netip.Prefix
-			if val.Addr().Is4() {
-				s, err = tmpAddr.Prefix(ipv4PeerMask)
-			} else {
-				s, err = tmpAddr.Prefix(ipv6PeerMask)
-			}
-			if err != nil {
-				return nil, nil, errors.New("error deducing new address")
-			}
-
-			clientAddress = append(clientAddress, c.String())
-			serverPeerIps = append(serverPeerIps, s.String())
+	for i, val := range addrs {
+		var sp netip.Prefix
+		if val.Is4() {
+			sp = netip.PrefixFrom(val, ipv4PeerMask)
 		} else {
-			return nil, nil, errors.New("network filled, no more peers can be added")
+			sp = netip.PrefixFrom(val, ipv6PeerMask)
 		}
+		clientAddress = append(clientAddress, netip.PrefixFrom(val, s.netIps[i].Bits()).String())
+		serverPeerIps = append(serverPeerIps, sp.String())
 	}
 	return clientAddress, serverPeerIps, nil
 }
 
-func (s *Store) AddKey(creds models.Credentials) (*models.ClientConfig, error) {
+// inverse of getNextIps, for releasing or re-reserving a peer's addresses
+func peerAddrs(clientAddress []string) ([]netip.Addr, error) {
+	addrs := make([]netip.Addr, 0, len(clientAddress))
+	for _, val := range clientAddress {
+		tmp, err := netip.ParsePrefix(val)
+		if err != nil {
+			return nil, err
+		}
+		addrs = append(addrs, tmp.Addr())
+	}
+	return addrs, nil
+}
+
+// The client's own name for it, the wge: comment quotes whatever needs it, so only what breaks a line is out
+func checkPeerName(name string) error {
+	switch {
+	case len(name) > maxPeerNameLen:
+		return fmt.Errorf("peer name is %d bytes long, at most %d are allowed, use a shorter client name", len(name), maxPeerNameLen)
+	case !utf8.ValidString(name):
+		return errors.New("peer name is not valid utf-8, rename the client")
+	case strings.ContainsFunc(name, unicode.IsControl):
+		return fmt.Errorf("peer name %q has control characters (newlines, tabs...), rename the client", name)
+	}
+	return nil
+}
+
+func (s *Store) AddKey(enroll models.EnrollRequest, req Requester) (*models.ClientConfig, error) {
 	s.Lock()
 	defer s.Unlock()
 
+	creds := enroll.Credentials
+	if err := checkPeerName(enroll.Name); err != nil {
+		return nil, err
+	}
+
 	// Verify keys
 	// psk
 	if creds.Psk != nil {
@@ -131,26 +200,67 @@ func (s *Store) AddKey(creds models.Credentials) (*models.ClientConfig, error) {
 	if _, ok := slices.BinarySearchFunc(s.pubKeys, pub, cmp); ok {
 		return nil, errors.New("rejected")
 	}
+	rule, err := s.evaluatePolicy(req)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.checkQuotas(req); err != nil {
+		return nil, err
+	}
 
-	// Assign ips, incr = 1(server ip) + previous peers
-	cIps, sIps, err := s.getNextIps(len(s.pubKeys) + 1)
+	// what the policy hands out, the defaults without one
+	allowedIps, err := s.allowedIps(rule, enroll.Routes)
 	if err != nil {
 		return nil, err
 	}
+	dns := s.dns
+	var pool []ipam.Range
+	var keepAlive *uint16
+	ruleName := ""
+	if rule != nil {
+		ruleName, pool, keepAlive = rule.Name, rule.pool, rule.KeepAlive
+		if len(rule.Dns) != 0 {
+			dns = rule.Dns
+		}
+	}
+
+	// subnets behind a site, routed to it by the server and kept out of its own tunnel
+	subnets, err := s.checkSubnets(enroll.Subnets)
+	if err != nil {
+		return nil, err
+	}
+	var routed []string
+	for _, val := range subnets {
+		routed = append(routed, val.String())
+	}
+	if len(routed) != 0 {
+		if allowedIps, err = models.SubtractAllowedIps(allowedIps, routed); err != nil {
+			return nil, err
+		}
+	}
+
+	// Assign ips
+	cIps, sIps, err := s.getNextIps(pool)
+	if err != nil {
+		return nil, err
+	}
+	sIps = append(sIps, routed...)
 
 	// conf to send to client
 	// send the same psk back but with server pub in the Credentials
+	fwMark := uint32(cmd.DefaultFWMark)
 	c := &models.ClientConfig{
 		Intrfc: models.Interface{
-			Dns:     s.dns,
+			Dns:     dns,
 			Address: cIps,
-			FwMark:  cmd.DefaultFWMark,
+			FwMark:  &fwMark,
 		},
 		Config: models.Config{
 			Peer: []models.Peer{
 				{
-					Endpoint: s.endpoint,
-					Ips:      DefaultAllowedIps[:],
+					Endpoint:  s.endpoint,
+					Ips:       allowedIps,
+					KeepAlive: keepAlive,
 					Credentials: models.Credentials{
 						Pub: s.pub.Bytes(),
 						Psk: creds.Psk,
@@ -159,24 +269,167 @@ func (s *Store) AddKey(creds models.Credentials) (*models.ClientConfig, error) {
 			},
 		},
 	}
+	// persist before dispatching, the conf is regenerated from this on restart
+	record := peerRecord{
+		Name:        enroll.Name,
+		Pub:         creds.Pub,
+		Psk:         creds.Psk,
+		Address:     cIps,
+		Ips:         sIps,
+		Enrolled:    time.Now().UTC(),
+		Subject:     req.Subject,
+		RemoteAddr:  req.RemoteAddr,
+		Org:         req.Org,
+		OrgUnit:     req.OrgUnit,
+		SANs:        req.SANs,
+		Fingerprint: req.Fingerprint,
+		Rule:        ruleName,
+		Subnets:     routed,
+	}
+	records := append(slices.Clip(s.records), record)
+	if err := saveState(s.statePath, records); err != nil {
+		log.Println("failure saving state...", err)
+		s.releaseIps(cIps)
+		return nil, errors.New("state failure")
+	}
+
 	// entry to process
 	p := procEntry{
-		ips:   sIps,
-		creds: creds,
+		ips:      sIps,
+		creds:    creds,
+		name:     enroll.Name,
+		req:      req,
+		enrolled: record.Enrolled,
+		routed:   len(routed) != 0,
 	}
 
 	select {
 	case s.processor.ch <- p:
 	default:
+		// undo the persisted record, nothing was dispatched
+		if err := saveState(s.statePath, s.records); err != nil {
+			log.Println("failure reverting state...", err)
+		}
+		s.releaseIps(cIps)
 		return nil, errors.New("buffer full")
 	}
 
+	s.records = records
 	s.pubKeys = append(s.pubKeys, pub)
 	slices.SortFunc(s.pubKeys, cmp)
 
+	if rule != nil {
+		log.Println("enrolled", enroll.Name, "for", req.Subject, "by policy rule:", ruleName)
+	}
 	return c, nil
 }
 
+// Revocation needs the preshared key the peer enrolled with, or the same cert subject for peers without one
+func (s *Store) RevokeKey(creds models.Credentials, req Requester) error {
+	s.Lock()
+	defer s.Unlock()
+
+	pub, err := ecdh.X25519().NewPublicKey(creds.Pub)
+	if err != nil {
+		return errors.New("invalid public key")
+	}
+
+	idx := slices.IndexFunc(s.records, func(r peerRecord) bool { return bytes.Equal(r.Pub, creds.Pub) })
+	if idx < 0 {
+		return ErrPeerNotFound
+	}
+	record := s.records[idx]
+	if len(record.Psk) != 0 {
+		if subtle.ConstantTimeCompare(record.Psk, creds.Psk) != 1 {
+			return ErrForbidden
+		}
+	} else if record.Subject == "" || record.Subject != req.Subject {
+		return ErrForbidden
+	}
+
+	records := slices.Delete(slices.Clone(s.records), idx, idx+1)
+	if err := saveState(s.statePath, records); err != nil {
+		log.Println("failure saving state...", err)
+		return errors.New("state failure")
+	}
+
+	p := procEntry{
+		creds:  models.Credentials{Pub: record.Pub},
+		revoke: true,
+		name:   record.Name,
+		req:    req,
+		routed: len(record.Subnets) != 0,
+	}
+	select {
+	case s.processor.ch <- p:
+	default:
+		if err := saveState(s.statePath, s.records); err != nil {
+			log.Println("failure reverting state...", err)
+		}
+		return errors.New("buffer full")
+	}
+
+	s.records = records
+	if i, ok := slices.BinarySearchFunc(s.pubKeys, pub, cmp); ok {
+		s.pubKeys = slices.Delete(s.pubKeys, i, i+1)
+	}
+	s.releaseIps(record.Address)
+	log.Println("revoked peer -", base64.StdEncoding.EncodeToString(record.Pub), ", requested by:", req.Subject)
+	return nil
+}
+
+// Enrolled peers, filtered by exact name and by a substring of the cert subject, empty filters match everything
+func (s *Store) List(name string, subject string) []models.PeerInfo {
+	s.Lock()
+	defer s.Unlock()
+
+	peers := make([]models.PeerInfo, 0, len(s.records)+len(s.imported))
+	for _, val := range s.records {
+		peers = append(peers, val.info())
+	}
+	peers = append(peers, s.imported...)
+	return slices.DeleteFunc(peers, func(info models.PeerInfo) bool {
+		return (name != "" && info.Name != name) || (subject != "" && !strings.Contains(info.Subject, subject))
+	})
+}
+
+func (s *Store) releaseIps(clientAddress []string) {
+	if addrs, err := peerAddrs(clientAddress); err == nil {
+		s.ipam.Release(addrs...)
+	}
+}
+
+// re-seed the key index and the peers of the server conf from the persisted state
+func (s *Store) restore() error {
+	records, err := loadState(s.statePath)
+	if err != nil {
+		return err
+	}
+
+	for _, val := range records {
+		pub, err := ecdh.X25519().NewPublicKey(val.Pub)
+		if err != nil {
+			return fmt.Errorf("invalid public key in state: %w", err)
+		}
+		addrs, err := peerAddrs(val.Address)
+		if err != nil {
+			return fmt.Errorf("invalid address in state: %w", err)
+		}
+		if err := s.ipam.Reserve(addrs...); err != nil {
+			return fmt.Errorf("address collision in state: %w", err)
+		}
+		s.pubKeys = append(s.pubKeys, pub)
+		s.processor.servConf.Peer = append(s.processor.servConf.Peer, val.peer())
+	}
+	slices.SortFunc(s.pubKeys, cmp)
+	if len(slices.CompactFunc(slices.Clone(s.pubKeys), func(a, b *ecdh.PublicKey) bool { return cmp(a, b) == 0 })) != len(s.pubKeys) {
+		return errors.New("duplicate public key in state")
+	}
+	s.records = records
+	log.Println("restored peers from state:", len(records))
+	return nil
+}
+
 func NewStore(servConf models.WGEServerConf) (store *Store, err error) {
 
 	store = &Store{
@@ -184,8 +437,7 @@ func NewStore(servConf models.WGEServerConf) (store *Store, err error) {
 		dns:     make([]string, 0, 2),
 		netIps:  make([]netip.Prefix, 0, 2),
 		processor: &Processor{
-			ch:             make(chan procEntry, 20),
-			systemdManager: dbusclient.DefaultSystemdManager,
+			ch: make(chan procEntry, 20),
 		},
 	}
 
@@ -195,11 +447,46 @@ func NewStore(servConf models.WGEServerConf) (store *Store, err error) {
 		return nil, errors.New("invalid device name")
 	}
 	proc.intrfc = servConf.Server.IntrfcName
-	proc.path = path.Join(wireguardPath, fmt.Sprintf("%s.conf", proc.intrfc))
-	log.Println("server conf path:", proc.path)
+	proc.path = confFilePath(servConf.Server)
+	proc.networkd = servConf.Server.ServiceManager == service.BackendNetworkd
+	if proc.networkd {
+		netdevPath, _ := networkdFilePaths(proc.path)
+		log.Println("server networkd netdev path:", netdevPath)
+	} else {
+		log.Println("server conf path:", proc.path)
+	}
+
+	// hand managed peers and settings of an existing conf, it's truncated otherwise
+	var existing *models.ServerConfig
+	if servConf.Server.MergeConf && proc.networkd {
+		return nil, errors.New("merging only reads wg-quick confs, not networkd ones")
+	} else if servConf.Server.MergeConf {
+		if existing, err = readExistingConf(proc.path); err != nil {
+			return nil, err
+		}
+	}
+
+	// service manager and what it does with the interface on shutdown
+	proc.serviceManager, err = service.New(servConf.Server.ServiceManager, service.Options{
+		RuntimeEnable: servConf.Server.RuntimeEnable,
+		ConfDir:       confDir(servConf.Server),
+	})
+	if err != nil {
+		return nil, err
+	}
+	if !service.ValidShutdownPolicy(servConf.Server.OnShutdown) {
+		return nil, fmt.Errorf("unknown shutdown policy %q, expected one of %v", servConf.Server.OnShutdown, service.ShutdownPolicies)
+	}
+	proc.onShutdown = servConf.Server.OnShutdown
+	if proc.onShutdown == "" {
+		proc.onShutdown = service.DefaultShutdown
+	}
+	log.Println("service manager:", servConf.Server.ServiceManager, ", on shutdown:", proc.onShutdown)
+
+	proc.backups = confBackups(servConf.Server)
 
 	// file lock
-	proc.fLock = flock.New(path.Join(os.TempDir(), fmt.Sprintf(".wge-%s", proc.intrfc)))
+	proc.fLock = flock.New(lockFilePath(proc.intrfc))
 
 	// set endpoint into store
 	if !servConf.Server.WireguardEndpoint.IsValid() {
@@ -230,12 +517,35 @@ func NewStore(servConf models.WGEServerConf) (store *Store, err error) {
 		}
 	}
 
-	// private key generation
+	// address pools, with the reserved ranges taken out
+	reserved := make([]ipam.Range, 0, len(servConf.Server.ReservedIps))
+	for _, val := range servConf.Server.ReservedIps {
+		r, err := ipam.ParseRange(val)
+		if err != nil {
+			return nil, fmt.Errorf("invalid reserved ips %q: %w", val, err)
+		}
+		reserved = append(reserved, r)
+	}
+	store.reserved = reserved
+	if store.ipam, err = ipam.New(store.netIps, reserved); err != nil {
+		return nil, err
+	}
+
+	// private key, loaded from the key file so that the public key handed out stays the same
 	var privTemp *ecdh.PrivateKey
-	if privTemp, err = ecdh.X25519().GenerateKey(rand.Reader); err != nil {
-		return
+	if existing != nil && servConf.Server.MergeKeepKey && len(existing.Intrfc.Priv) != 0 {
+		if privTemp, err = ecdh.X25519().NewPrivateKey(existing.Intrfc.Priv); err != nil {
+			return nil, fmt.Errorf("invalid private key in existing conf: %w", err)
+		}
+		if err := keepKeyFile(keyFilePath(servConf.Server), privTemp); err != nil {
+			return nil, err
+		}
+		log.Println("keeping private key of existing conf")
+	} else if privTemp, err = loadOrCreateKey(keyFilePath(servConf.Server)); err != nil {
+		return nil, err
 	}
 	store.pub = privTemp.PublicKey()
+	log.Println("wireguard public key:", base64.StdEncoding.EncodeToString(store.pub.Bytes()))
 
 	// set private to conf
 	servConf.WgInterface.Priv = privTemp.Bytes()
@@ -244,7 +554,52 @@ func NewStore(servConf models.WGEServerConf) (store *Store, err error) {
 	proc.servConf = models.ServerConfig{
 		Intrfc: servConf.WgInterface,
 	}
-	proc.servConf.Intrfc.ListenPort = int32(servConf.Server.WireguardEndpoint.Port())
+	// listening on the endpoint port unless set explicitly
+	if proc.servConf.Intrfc.ListenPort == nil {
+		port := servConf.Server.WireguardEndpoint.Port()
+		proc.servConf.Intrfc.ListenPort = &port
+	}
+	if existing != nil && servConf.Server.MergeKeepPort && existing.Intrfc.ListenPort != nil {
+		proc.servConf.Intrfc.ListenPort = existing.Intrfc.ListenPort
+	}
+
+	// previously enrolled peers
+	store.statePath = stateFilePath(servConf.Server)
+	store.quotas = servConf.Server.Quotas
+	if store.routes, err = compileRoutes(servConf.Server.Routes, store.netIps); err != nil {
+		return nil, err
+	}
+	for _, val := range servConf.Server.RoutedSubnets {
+		prefix, err := netip.ParsePrefix(val)
+		if err != nil {
+			return nil, fmt.Errorf("invalid routed subnets %q: %w", val, err)
+		}
+		store.routedSubnets = append(store.routedSubnets, prefix.Masked())
+	}
+	store.pushSubnets = servConf.Server.PushRoutedSubnets
+	if store.policy, err = compilePolicy(servConf.Policy, store.netIps, store.routes); err != nil {
+		return nil, err
+	}
+	log.Println("state path:", store.statePath)
+	proc.statePath = store.statePath
+	proc.historyDir = historyDirPath(servConf.Server)
+	proc.historyKeep = historyVersionsKept(servConf.Server)
+	if err := store.restore(); err != nil {
+		return nil, err
+	}
+	if existing != nil {
+		if err := store.importPeers(existing.Peer); err != nil {
+			return nil, err
+		}
+	}
+
+	// live peer updates, the interface is expected to be up by the time entries come in
+	if servConf.Server.Netlink {
+		if proc.netlink, err = netlinkclient.New(); err != nil {
+			return nil, err
+		}
+		log.Println("applying peers live through netlink")
+	}
 
 	terminator.HookInto(store.processor.RunProcessor)
 	return store, nil
@@ -252,59 +607,162 @@ func NewStore(servConf models.WGEServerConf) (store *Store, err error) {
 
 /** --- Processor --- */
 
-func (p *Processor) initializeServerConf() error {
-	buf, err := p.servConf.MarshalText()
-	if err != nil {
+// writes the interface and every known peer as a whole new conf, see writeInterfaceConf
+func (p *Processor) writeServerConf() error {
+	return writeInterfaceConf(p.path, p.intrfc, p.servConf, p.networkd, p.backups)
+}
+
+// swaps in the peers and writes the conf, the previous peers are kept if the write fails
+func (p *Processor) writePeers(peers []models.Peer) error {
+	prev := p.servConf.Peer
+	p.servConf.Peer = peers
+	if err := p.writeServerConf(); err != nil {
+		p.servConf.Peer = prev
 		return err
 	}
+	return nil
+}
 
-	f, err := os.OpenFile(p.path, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0o640)
-	if err != nil {
-		return err
+// might already be gone if the conf was rolled back since
+func (p *Processor) removePeer(pub models.Key) error {
+	p.heldBack = slices.DeleteFunc(p.heldBack, func(peer models.Peer) bool { return bytes.Equal(peer.Pub, pub) })
+	idx := slices.IndexFunc(p.servConf.Peer, func(peer models.Peer) bool { return bytes.Equal(peer.Pub, pub) })
+	if idx < 0 {
+		log.Println("peer not in server conf, nothing to remove...")
+		return nil
 	}
-	defer f.Close()
+	return p.writePeers(slices.Delete(slices.Clone(p.servConf.Peer), idx, idx+1))
+}
 
-	// check fstat once, just to be sure, just to check if there is a mode mismatch
-	if fstat, err := f.Stat(); err != nil {
-		return err
-	} else if fstat.Mode()&0o640 == 0 {
-		// might happen if the file is already present but with different mode
-		return errors.New("device file mode mismatch")
+func (p *Processor) processEntry(entry procEntry) error {
+	var err error
+	if entry.revoke {
+		err = p.removePeer(entry.creds.Pub)
+	} else {
+		peer := models.Peer{
+			Ips:         entry.ips,
+			Credentials: entry.creds,
+		}
+		peer.SetMeta(entry.meta())
+		err = p.writePeers(append(slices.Clip(p.servConf.Peer), peer))
+	}
+	if err == nil {
+		p.changes = append(p.changes, entry.change())
 	}
+	return err
+}
 
-	if _, err := fmt.Fprint(f, string(buf)); err != nil {
-		return err
+// the running interface matches the conf, which makes it a version in the history
+func (p *Processor) markGood() {
+	p.goodPeers = slices.Clone(p.servConf.Peer)
+	p.recordHistory("")
+}
+
+// On failure the conf is rolled back to the peers the service last ran with and restarted once more.
+// Peers revoked since then stay out, enrolled ones are held back and tried again with the next batch.
+func (p *Processor) restart() error {
+	if len(p.heldBack) != 0 {
+		if err := p.writePeers(append(slices.Clip(p.servConf.Peer), p.heldBack...)); err != nil {
+			return fmt.Errorf("failure re-adding held back peers: %w", err)
+		}
+		p.heldBack = nil
+	}
+	err := p.serviceManager.RestartService(p.intrfc)
+	if err == nil {
+		p.markGood()
+		return nil
 	}
+	log.Println("failure restarting service, rolling back conf...", err)
+
+	// the current conf has every processed revoke applied, a good peer missing from it is revoked
+	rollback := make([]models.Peer, 0, len(p.goodPeers))
+	revoked := 0
+	for _, val := range p.goodPeers {
+		idx := slices.IndexFunc(p.servConf.Peer, func(peer models.Peer) bool { return bytes.Equal(peer.Pub, val.Pub) })
+		if idx == -1 {
+			revoked++
+			continue
+		}
+		rollback = append(rollback, p.servConf.Peer[idx])
+	}
+	var heldBack []models.Peer
+	for _, val := range p.servConf.Peer {
+		if !slices.ContainsFunc(rollback, func(peer models.Peer) bool { return bytes.Equal(peer.Pub, val.Pub) }) {
+			heldBack = append(heldBack, val)
+		}
+	}
+
+	if err := p.writePeers(rollback); err != nil {
+		return fmt.Errorf("failure rolling back conf: %w", err)
+	}
+	if err := p.serviceManager.RestartService(p.intrfc); err != nil {
+		return fmt.Errorf("failure restarting service with rolled back conf: %w", err)
+	}
+	p.heldBack = heldBack
+	log.Println("rolled back conf, enrolled peers held back until the next batch:", len(heldBack), ", revoked peers kept out:", revoked)
+	p.changes = nil
+	p.recordHistory("rolled back after failed restart")
 	return nil
 }
 
-func (p *Processor) processEntry(entry procEntry) error {
-	peerConf := &models.Config{
-		Peer: []models.Peer{
-			{
-				Ips:         entry.ips,
-				Credentials: entry.creds,
-			},
-		},
+// writes the entry to the conf and applies it live if possible, refresh is set when a service restart is still needed
+func (p *Processor) handleEntry(entry procEntry) (refresh bool, err error) {
+	if err := p.processEntry(entry); err != nil {
+		return true, err
 	}
-	if buf, err := peerConf.MarshalText(); err != nil {
-		return err
-	} else {
-		f, err := os.OpenFile(p.path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0o640)
+	// held back peers only come back with a restart
+	if p.netlink == nil || entry.routed || len(p.heldBack) != 0 {
+		return true, nil
+	}
+	if err := p.applyLive(entry); err != nil {
+		log.Println("failure applying entry live, falling back to restart...", err)
+		return true, nil
+	}
+	return false, nil
+}
+
+// conf is already written by processEntry, this only syncs the running device
+func (p *Processor) applyLive(entry procEntry) error {
+	peer := netlinkclient.PeerConfig{
+		PublicKey:    entry.creds.Pub,
+		PresharedKey: entry.creds.Psk,
+		Remove:       entry.revoke,
+	}
+	for _, val := range entry.ips {
+		tmp, err := netip.ParsePrefix(val)
 		if err != nil {
 			return err
 		}
-		defer f.Close()
-		if _, err := f.Write(buf); err != nil {
-			return err
-		}
+		peer.AllowedIPs = append(peer.AllowedIPs, tmp)
 	}
-	return nil
+	return p.netlink.ConfigurePeers(p.intrfc, []netlinkclient.PeerConfig{peer})
+}
 
+// pending entries only need a restart if the interface is staying up
+func (p *Processor) shutdown(pending bool) {
+	switch p.onShutdown {
+	case service.ShutdownDown:
+		if err := p.serviceManager.StopService(p.intrfc); err != nil {
+			log.Println("failure stopping service...", err)
+		}
+	case service.ShutdownDisable:
+		if err := p.serviceManager.DisableAndStopService(p.intrfc); err != nil {
+			log.Println("failure disabling service...", err)
+		}
+	default:
+		if pending {
+			if err := p.restart(); err != nil {
+				log.Println("failure restarting service...", err)
+			}
+		}
+	}
 }
 
 func (p *Processor) RunProcessor(ctx context.Context, cancel context.CancelFunc) {
 	defer cancel()
+	if p.netlink != nil {
+		defer p.netlink.Close()
+	}
 	if ok, err := p.fLock.TryLock(); err != nil || !ok {
 		log.Println("another instance is currently running...", err)
 		return
@@ -312,16 +770,21 @@ func (p *Processor) RunProcessor(ctx context.Context, cancel context.CancelFunc)
 	defer p.fLock.Unlock()
 
 	// write the initial interface to conf file, we already have fLock
-	if err := p.initializeServerConf(); err != nil {
+	if err := p.writeServerConf(); err != nil {
 		log.Println("failure initializing server conf file with interface...", err)
 		return
 	}
 
 	// try enabling the service
-	if err := p.systemdManager.EnableAndStartService(p.intrfc); err != nil {
+	if err := p.serviceManager.EnableAndStartService(p.intrfc); err != nil {
 		log.Println("failure enabling service", err)
+		// don't leave a half started interface enabled behind
+		if err := p.serviceManager.DisableAndStopService(p.intrfc); err != nil {
+			log.Println("failure disabling service", err)
+		}
 		return
 	}
+	p.markGood()
 
 	tick := time.NewTicker(1 * time.Second)
 	defer tick.Stop()
@@ -331,29 +794,30 @@ func (p *Processor) RunProcessor(ctx context.Context, cancel context.CancelFunc)
 	for range tick.C {
 		select {
 		case <-ctx.Done():
-			// cleanup
-			if unRefreshed > 0 {
-				if err := p.systemdManager.RestartService(p.intrfc); err != nil {
-					log.Println("failure restarting service...", err)
-				}
-			}
+			p.shutdown(unRefreshed > 0)
 			return
 		case entry := <-p.ch:
-			if err := p.processEntry(entry); err != nil {
+			refresh, err := p.handleEntry(entry)
+			if err != nil {
 				log.Println("failure to add entry...", err)
 				// disable server and stop service on error
-				if err := p.systemdManager.DisableAndStopService(p.intrfc); err != nil {
+				if err := p.serviceManager.DisableAndStopService(p.intrfc); err != nil {
 					log.Println("failure disabling service", err)
 				}
 				// manually trigger cancel, we need to complete another iteration for cleanup
 				cancel()
 			}
-			unRefreshed += 1
+			if refresh {
+				unRefreshed += 1
+			} else if unRefreshed == 0 {
+				// applied live, nothing pending
+				p.markGood()
+			}
 		default:
 		}
 
 		if unRefreshed > 0 && time.Since(prevTime) > time.Minute {
-			if err := p.systemdManager.RestartService(p.intrfc); err != nil {
+			if err := p.restart(); err != nil {
 				log.Println("failure restarting service...", err)
 				return
 			}
@@ -0,0 +1,760 @@
+package processor
+
+import (
+	"bytes"
+	"crypto/ecdh"
+	"encoding/base64"
+	"errors"
+	"net/netip"
+	"os"
+	"os/user"
+	"path"
+	"slices"
+	"strings"
+	"testing"
+
+	"wg-exchange/cmd/wge-server/ipam"
+	netlinkclient "wg-exchange/cmd/wge-server/netlink_client"
+	"wg-exchange/cmd/wge-server/service"
+	"wg-exchange/models"
+)
+
+type fakeNetlink struct {
+	peers []netlinkclient.PeerConfig
+	err   error
+}
+
+func (f *fakeNetlink) ConfigurePeers(device string, peers []netlinkclient.PeerConfig) error {
+	if f.err != nil {
+		return f.err
+	}
+	f.peers = append(f.peers, peers...)
+	return nil
+}
+
+func (f *fakeNetlink) Close() error {
+	return nil
+}
+
+func testProcessor(t *testing.T, nl netlinkclient.Client) *Processor {
+	port := uint16(51820)
+	p := &Processor{
+		intrfc:  "wgtest",
+		path:    path.Join(t.TempDir(), "wgtest.conf"),
+		netlink: nl,
+		servConf: models.ServerConfig{
+			Intrfc: models.Interface{
+				ListenPort: &port,
+				Address:    []string{"10.0.0.1/24"},
+				Priv:       make([]byte, 32),
+			},
+		},
+	}
+	if err := p.writeServerConf(); err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func testEntry(b byte, revoke bool) procEntry {
+	return procEntry{
+		creds: models.Credentials{
+			Pub: bytes.Repeat([]byte{b}, 32),
+			Psk: bytes.Repeat([]byte{b + 1}, 32),
+		},
+		ips:    []string{"10.0.0.2/32"},
+		revoke: revoke,
+	}
+}
+
+// a store with its state in a temp dir, entries pile up in the processor channel
+func testStore(t *testing.T) *Store {
+	p := testProcessor(t, nil)
+	p.ch = make(chan procEntry, 20)
+	netIps := []netip.Prefix{netip.MustParsePrefix("10.0.0.1/24")}
+	alloc, err := ipam.New(netIps, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.statePath = path.Join(t.TempDir(), "state.json")
+	return &Store{
+		netIps:    netIps,
+		ipam:      alloc,
+		pub:       must(ecdh.X25519().NewPublicKey(bytes.Repeat([]byte{9}, 32))),
+		statePath: p.statePath,
+		processor: p,
+	}
+}
+
+func must[T any](val T, err error) T {
+	if err != nil {
+		panic(err)
+	}
+	return val
+}
+
+func testEnroll(b byte, name string) models.EnrollRequest {
+	return models.EnrollRequest{Credentials: testEntry(b, false).creds, Name: name}
+}
+
+func TestHandleEntryLive(t *testing.T) {
+	nl := &fakeNetlink{}
+	p := testProcessor(t, nl)
+
+	if refresh, err := p.handleEntry(testEntry(1, false)); err != nil || refresh {
+		t.Fatal("expected live add without restart, got", refresh, err)
+	}
+	if len(nl.peers) != 1 || nl.peers[0].Remove || nl.peers[0].AllowedIPs[0] != netip.MustParsePrefix("10.0.0.2/32") {
+		t.Fatal("unexpected netlink add:", nl.peers)
+	}
+
+	// conf still written for persistence
+	buf, err := os.ReadFile(p.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(buf), "AllowedIPs = 10.0.0.2/32") {
+		t.Fatal("peer missing from conf:\n", string(buf))
+	}
+
+	if refresh, err := p.handleEntry(testEntry(1, true)); err != nil || refresh {
+		t.Fatal("expected live removal without restart, got", refresh, err)
+	}
+	if len(nl.peers) != 2 || !nl.peers[1].Remove {
+		t.Fatal("unexpected netlink removal:", nl.peers)
+	}
+	if buf, _ := os.ReadFile(p.path); strings.Contains(string(buf), "[Peer]") {
+		t.Fatal("peer not removed from conf:\n", string(buf))
+	}
+}
+
+func TestHandleEntryFallback(t *testing.T) {
+	// netlink failure falls back to restarting
+	p := testProcessor(t, &fakeNetlink{err: errors.New("no device")})
+	if refresh, err := p.handleEntry(testEntry(1, false)); err != nil || !refresh {
+		t.Fatal("expected restart fallback, got", refresh, err)
+	}
+
+	// and without netlink it always restarts
+	p = testProcessor(t, nil)
+	if refresh, err := p.handleEntry(testEntry(1, false)); err != nil || !refresh {
+		t.Fatal("expected restart, got", refresh, err)
+	}
+}
+
+func TestImportPeers(t *testing.T) {
+	p := testProcessor(t, nil)
+	alloc, err := ipam.New([]netip.Prefix{netip.MustParsePrefix("10.0.0.1/24")}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &Store{ipam: alloc, processor: p}
+
+	peers := []models.Peer{
+		{Comment: "wge:name=laptop cert=\"CN=WG-Client,O=Test\"", Ips: []string{"10.0.0.2/32"}, Credentials: testEntry(1, false).creds},
+		{Ips: []string{"10.0.0.4/31", "0.0.0.0/0"}, Credentials: testEntry(3, false).creds},
+	}
+	if err := s.importPeers(peers); err != nil {
+		t.Fatal(err)
+	}
+	if len(s.pubKeys) != 2 || len(p.servConf.Peer) != 2 {
+		t.Fatal("peers not imported")
+	}
+	// listed by the name and subject from the comment
+	if listed := s.List("laptop", "WG-Client"); len(listed) != 1 || listed[0].Subject != "CN=WG-Client,O=Test" {
+		t.Fatal("imported peer not listed:", listed)
+	}
+	// .2 and .4-.5 are taken, the default route doesn't empty the pool
+	for _, expected := range []string{"10.0.0.3", "10.0.0.6"} {
+		addrs, err := alloc.Allocate()
+		if err != nil || addrs[0].String() != expected {
+			t.Fatal("expected", expected, "got", addrs, err)
+		}
+	}
+
+	// already known keys are skipped, colliding addresses are not
+	if err := s.importPeers(peers[:1]); err != nil || len(p.servConf.Peer) != 2 {
+		t.Fatal("known peer imported again", err)
+	}
+	collision := []models.Peer{{Ips: []string{"10.0.0.3/32"}, Credentials: testEntry(5, false).creds}}
+	if err := s.importPeers(collision); err == nil {
+		t.Fatal("expected an address collision")
+	}
+
+	// ReservedIPs are out of the pool already, hand managed peers in there only collide with each other
+	reserved := []ipam.Range{{First: netip.MustParseAddr("10.0.0.8"), Last: netip.MustParseAddr("10.0.0.15")}}
+	if s.ipam, err = ipam.New([]netip.Prefix{netip.MustParsePrefix("10.0.0.1/24")}, reserved); err != nil {
+		t.Fatal(err)
+	}
+	s.reserved = reserved
+	inReserved := []models.Peer{{Ips: []string{"10.0.0.10/32"}, Credentials: testEntry(7, false).creds}}
+	if err := s.importPeers(inReserved); err != nil {
+		t.Fatal("expected the reserved address accepted, got", err)
+	}
+	inReserved = []models.Peer{{Ips: []string{"10.0.0.10/32"}, Credentials: testEntry(9, false).creds}}
+	if err := s.importPeers(inReserved); err == nil {
+		t.Fatal("expected a collision with the other imported peer")
+	}
+}
+
+func TestWriteConfBackups(t *testing.T) {
+	confPath := path.Join(t.TempDir(), "wgtest.conf")
+	for i := range 4 {
+		if err := writeConfAtomic(confPath, []byte{byte('0' + i)}, 2); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for file, expected := range map[string]string{confPath: "3", backupPath(confPath, 1): "2", backupPath(confPath, 2): "1"} {
+		if buf, err := os.ReadFile(file); err != nil || string(buf) != expected {
+			t.Fatal(file, "expected", expected, "got", string(buf), err)
+		}
+	}
+	if _, err := os.Stat(backupPath(confPath, 3)); err == nil {
+		t.Fatal("more backups than kept")
+	}
+	if entries, _ := os.ReadDir(path.Dir(confPath)); len(entries) != 3 {
+		t.Fatal("leftover temp files:", entries)
+	}
+}
+
+// fails the first n restarts
+type failingManager struct {
+	service.DryRunManager
+	failures int
+	restarts int
+}
+
+func (f *failingManager) RestartService(intrfc string) error {
+	f.restarts += 1
+	if f.restarts <= f.failures {
+		return errors.New("restart failed")
+	}
+	return nil
+}
+
+func TestRestartRollback(t *testing.T) {
+	p := testProcessor(t, nil)
+	manager := &failingManager{failures: 1}
+	p.serviceManager = manager
+	p.markGood()
+
+	if _, err := p.handleEntry(testEntry(1, false)); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.restart(); err != nil {
+		t.Fatal("expected a successful rollback, got", err)
+	}
+	if manager.restarts != 2 || len(p.servConf.Peer) != 0 {
+		t.Fatal("conf not rolled back:", manager.restarts, p.servConf.Peer)
+	}
+	if buf, _ := os.ReadFile(p.path); strings.Contains(string(buf), "[Peer]") {
+		t.Fatal("peer still in conf:\n", string(buf))
+	}
+
+	// revoking a rolled back peer is fine
+	if _, err := p.handleEntry(testEntry(1, true)); err != nil {
+		t.Fatal(err)
+	}
+
+	// nothing left to roll back to
+	manager.failures = 4
+	if err := p.restart(); err == nil {
+		t.Fatal("expected a restart failure")
+	}
+}
+
+// peers revoked since the last good restart don't come back with the rollback
+func TestRestartRollbackRevoked(t *testing.T) {
+	p := testProcessor(t, nil)
+	manager := &failingManager{}
+	p.serviceManager = manager
+	for _, val := range []byte{1, 3} {
+		if _, err := p.handleEntry(testEntry(val, false)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	p.markGood()
+
+	if _, err := p.handleEntry(testEntry(3, true)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := p.handleEntry(testEntry(5, false)); err != nil {
+		t.Fatal(err)
+	}
+	manager.failures = 1
+	if err := p.restart(); err != nil {
+		t.Fatal("expected a successful rollback, got", err)
+	}
+	if len(p.servConf.Peer) != 1 || !bytes.Equal(p.servConf.Peer[0].Pub, testEntry(1, false).creds.Pub) {
+		t.Fatal("expected only the unrevoked good peer, got", p.servConf.Peer)
+	}
+}
+
+// peers held back by a rollback are back in once the next batch restarts fine, unless revoked meanwhile
+func TestRestartRollbackHeldBack(t *testing.T) {
+	p := testProcessor(t, nil)
+	manager := &failingManager{failures: 1}
+	p.serviceManager = manager
+	p.markGood()
+
+	for _, val := range []byte{1, 3} {
+		if _, err := p.handleEntry(testEntry(val, false)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := p.restart(); err != nil {
+		t.Fatal("expected a successful rollback, got", err)
+	}
+	if len(p.servConf.Peer) != 0 || len(p.heldBack) != 2 {
+		t.Fatal("expected both peers held back, got", p.servConf.Peer, p.heldBack)
+	}
+
+	if _, err := p.handleEntry(testEntry(3, true)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := p.handleEntry(testEntry(5, false)); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.restart(); err != nil {
+		t.Fatal(err)
+	}
+	pubs := make([]byte, 0, len(p.servConf.Peer))
+	for _, val := range p.servConf.Peer {
+		pubs = append(pubs, val.Pub[0])
+	}
+	slices.Sort(pubs)
+	if !slices.Equal(pubs, []byte{1, 5}) || len(p.heldBack) != 0 || len(p.goodPeers) != 2 {
+		t.Fatal("expected the held back and the new peer in the conf, got", pubs, p.heldBack)
+	}
+	if buf, _ := os.ReadFile(p.path); strings.Count(string(buf), "[Peer]") != 2 {
+		t.Fatal("expected both peers in the conf:\n", string(buf))
+	}
+}
+
+func TestHistory(t *testing.T) {
+	dir := t.TempDir()
+	for _, conf := range []string{"a\nb\n", "a\nb\n", "a\nc\n"} {
+		if err := saveSnapshot(dir, &snapshot{Conf: conf}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// the unchanged conf isn't a version
+	if versions, err := historyVersions(dir); err != nil || !slices.Equal(versions, []int{1, 2}) {
+		t.Fatal("unexpected versions:", versions, err)
+	}
+
+	// only the newest are kept, numbering goes on
+	for _, conf := range []string{"d\n", "e\n"} {
+		if err := saveSnapshot(dir, &snapshot{Conf: conf}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := pruneHistory(dir, 2); err != nil {
+		t.Fatal(err)
+	}
+	if versions, err := historyVersions(dir); err != nil || !slices.Equal(versions, []int{3, 4}) {
+		t.Fatal("unexpected versions after pruning:", versions, err)
+	}
+
+	diff := diffLines([]string{"a", "b", "d"}, []string{"a", "c", "d"})
+	if !slices.Equal(diff, []string{" a", "-b", "+c", " d"}) {
+		t.Fatal("unexpected diff:", diff)
+	}
+}
+
+func TestConfPaths(t *testing.T) {
+	cases := []struct {
+		server   models.WGEServer
+		expected string
+	}{
+		{models.WGEServer{IntrfcName: "wg0"}, "/etc/wireguard/wg0.conf"},
+		{models.WGEServer{IntrfcName: "wg0", ServiceManager: service.BackendNetworkd}, "/etc/systemd/network/wg0.conf"},
+		{models.WGEServer{IntrfcName: "wg0", ServiceManager: service.BackendNetworkd, WireguardPath: "/run/systemd/network"}, "/run/systemd/network/wg0.conf"},
+	}
+	for _, c := range cases {
+		if confPath := confFilePath(c.server); confPath != c.expected {
+			t.Errorf("expected %s, got %s", c.expected, confPath)
+		}
+	}
+	if netdev, network := networkdFilePaths("/etc/systemd/network/wg0.conf"); netdev != "/etc/systemd/network/wg0.netdev" || network != "/etc/systemd/network/wg0.network" {
+		t.Error("unexpected networkd paths:", netdev, network)
+	}
+}
+
+func TestWriteNetworkdConf(t *testing.T) {
+	if _, err := user.LookupGroup(networkdGroup); err != nil || os.Geteuid() != 0 {
+		t.Skip("needs root and the systemd-network group")
+	}
+	p := testProcessor(t, nil)
+	p.networkd = true
+	p.servConf.Peer = []models.Peer{{Ips: []string{"10.0.0.2/32"}, Credentials: testEntry(1, false).creds}}
+	if err := p.writeServerConf(); err != nil {
+		t.Fatal(err)
+	}
+
+	netdevPath, networkPath := networkdFilePaths(p.path)
+	netdev, err1 := os.ReadFile(netdevPath)
+	network, err2 := os.ReadFile(networkPath)
+	if err := errors.Join(err1, err2); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(netdev), "[WireGuardPeer]\nPublicKey=") || !strings.Contains(string(netdev), "RouteTable=main") || !strings.Contains(string(network), "Address=10.0.0.1/24") {
+		t.Fatalf("unexpected networkd conf:\n%s\n%s", netdev, network)
+	}
+}
+
+func TestCheckQuotas(t *testing.T) {
+	laptop := Requester{Subject: "CN=laptop,OU=dev,O=Test", Org: []string{"Test"}, OrgUnit: []string{"dev"}}
+	phone := Requester{Subject: "CN=phone,OU=dev,O=Test", Org: []string{"Test"}, OrgUnit: []string{"dev"}}
+	s := &Store{
+		records: []peerRecord{
+			{Subject: laptop.Subject, Org: laptop.Org, OrgUnit: laptop.OrgUnit},
+			{Subject: laptop.Subject, Org: laptop.Org, OrgUnit: laptop.OrgUnit},
+		},
+		quotas: models.Quotas{PerIdentity: 2, PerOrgUnit: 3, Identities: map[string]int{phone.Subject: 0}},
+	}
+
+	if err := s.checkQuotas(laptop); !errors.Is(err, ErrOverQuota) {
+		t.Fatal("expected the identity over quota, got", err)
+	}
+	// entries are exact, 0 allows none
+	if err := s.checkQuotas(phone); !errors.Is(err, ErrOverQuota) {
+		t.Fatal("expected no peers allowed, got", err)
+	}
+	other := Requester{Subject: "CN=desktop,OU=dev,O=Test", Org: []string{"Test"}, OrgUnit: []string{"dev"}}
+	if err := s.checkQuotas(other); err != nil {
+		t.Fatal("expected room in the OU, got", err)
+	}
+	s.records = append(s.records, peerRecord{Subject: "CN=tablet,OU=dev,O=Test", OrgUnit: []string{"dev"}})
+	if err := s.checkQuotas(other); !errors.Is(err, ErrOverQuota) {
+		t.Fatal("expected the OU over quota, got", err)
+	}
+}
+
+func TestPolicy(t *testing.T) {
+	netIps := []netip.Prefix{netip.MustParsePrefix("10.0.0.1/24")}
+	if _, err := compilePolicy([]models.PolicyRule{{Action: "maybe"}}, netIps, nil); err == nil {
+		t.Fatal("expected an invalid action")
+	}
+	if _, err := compilePolicy([]models.PolicyRule{{Action: policyAllow, Pool: []string{"10.1.0.0/24"}}}, netIps, nil); err == nil {
+		t.Fatal("expected a pool outside of the interface networks")
+	}
+
+	policy, err := compilePolicy([]models.PolicyRule{
+		{Name: "guests", Action: policyDeny, OrgUnit: []string{"guest*"}},
+		{Name: "phones", Action: policyAllow, CommonName: []string{"*-phone"}, Source: []string{"192.168.0.0/16"}, Pool: []string{"10.0.0.128-10.0.0.254"}},
+		{Action: policyAllow, SAN: []string{"email:*@test.org"}},
+	}, netIps, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &Store{policy: policy}
+
+	guest := Requester{CommonName: "someone-phone", OrgUnit: []string{"guests"}, RemoteAddr: "192.168.1.2:4000"}
+	if rule, err := s.evaluatePolicy(guest); !errors.Is(err, ErrPolicyDenied) || rule.Name != "guests" {
+		t.Fatal("expected the guest denied, got", rule, err)
+	}
+	phone := Requester{CommonName: "someone-phone", RemoteAddr: "[::ffff:192.168.1.2]:4000"}
+	if rule, err := s.evaluatePolicy(phone); err != nil || rule.Name != "phones" || len(rule.pool) != 1 {
+		t.Fatal("expected the phone rule, got", rule, err)
+	}
+	phone.RemoteAddr = "172.16.0.2:4000"
+	if _, err := s.evaluatePolicy(phone); !errors.Is(err, ErrPolicyDenied) {
+		t.Fatal("expected no rule outside the source network, got", err)
+	}
+	mail := Requester{SANs: []string{"DNS:laptop.test.org", "email:someone@test.org"}}
+	if rule, err := s.evaluatePolicy(mail); err != nil || rule.Name != "#3" {
+		t.Fatal("expected the unnamed rule, got", rule, err)
+	}
+
+	// no rules, everything goes
+	if rule, err := (&Store{}).evaluatePolicy(guest); rule != nil || err != nil {
+		t.Fatal("expected no policy, got", rule, err)
+	}
+}
+
+func TestAllowedIps(t *testing.T) {
+	netIps := []netip.Prefix{netip.MustParsePrefix("10.0.0.1/24"), netip.MustParsePrefix("fd00::1/64")}
+	if _, err := compileRoutes(map[string][]string{models.RoutesVPN: {"10.1.0.0/16"}}, netIps); err == nil {
+		t.Fatal("expected vpn to be reserved")
+	}
+	routes, err := compileRoutes(map[string][]string{"office": {"10.1.0.0/16"}, "lab": {"10.2.0.0/16"}}, netIps)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(routes[models.RoutesVPN], []string{"10.0.0.0/24", "fd00::/64"}) {
+		t.Fatal("unexpected vpn routes", routes[models.RoutesVPN])
+	}
+	if _, err := compilePolicy([]models.PolicyRule{{Action: policyAllow, Routes: []string{"home"}}}, netIps, routes); err == nil {
+		t.Fatal("expected an unknown route set")
+	}
+
+	s := &Store{routes: routes}
+	if ips, err := s.allowedIps(nil, ""); err != nil || !slices.Equal(ips, DefaultAllowedIps[:]) {
+		t.Fatal("expected the full tunnel by default, got", ips, err)
+	}
+	if ips, err := s.allowedIps(nil, "lab"); err != nil || !slices.Equal(ips, []string{"10.2.0.0/16"}) {
+		t.Fatal("expected the lab routes, got", ips, err)
+	}
+	if _, err := s.allowedIps(nil, "home"); err == nil {
+		t.Fatal("expected an unknown route set")
+	}
+
+	rule := &policyRule{PolicyRule: models.PolicyRule{Name: "staff", Routes: []string{"office", models.RoutesVPN}}}
+	if ips, err := s.allowedIps(rule, ""); err != nil || !slices.Equal(ips, []string{"10.1.0.0/16"}) {
+		t.Fatal("expected the first set of the rule, got", ips, err)
+	}
+	if ips, err := s.allowedIps(rule, models.RoutesVPN); err != nil || len(ips) != 2 {
+		t.Fatal("expected the vpn routes, got", ips, err)
+	}
+	if _, err := s.allowedIps(rule, models.RoutesFull); !errors.Is(err, ErrPolicyDenied) {
+		t.Fatal("expected the full tunnel denied, got", err)
+	}
+	// fixed AllowedIPs, nothing else can be asked for
+	rule = &policyRule{PolicyRule: models.PolicyRule{Name: "fixed", AllowedIps: []string{"10.0.0.0/24"}}}
+	if _, err := s.allowedIps(rule, "office"); !errors.Is(err, ErrPolicyDenied) {
+		t.Fatal("expected the office routes denied, got", err)
+	}
+
+	rule = &policyRule{PolicyRule: models.PolicyRule{Name: "lan", ExcludeIps: []string{"128.0.0.0/1", "::/1"}}}
+	if ips, err := s.allowedIps(rule, ""); err != nil || !slices.Equal(ips, []string{"0.0.0.0/1", "8000::/1"}) {
+		t.Fatal("expected the excludes taken out, got", ips, err)
+	}
+}
+
+func TestCheckSubnets(t *testing.T) {
+	s := &Store{
+		netIps: []netip.Prefix{netip.MustParsePrefix("10.0.0.1/24")},
+		records: []peerRecord{
+			{Ips: []string{"10.0.0.2/32", "172.16.1.0/24"}, Subnets: []string{"172.16.1.0/24"}},
+		},
+		imported: []models.PeerInfo{{Address: []string{"10.0.0.3/32", "172.16.2.0/24"}}},
+	}
+	if _, err := s.checkSubnets([]string{"172.16.3.0/24"}); !errors.Is(err, ErrPolicyDenied) {
+		t.Fatal("expected no routed subnets allowed, got", err)
+	}
+
+	s.routedSubnets = []netip.Prefix{netip.MustParsePrefix("172.16.0.0/12"), netip.MustParsePrefix("10.0.0.0/16")}
+	if subnets, err := s.checkSubnets([]string{"172.16.3.0/24", "172.17.0.0/16"}); err != nil || len(subnets) != 2 {
+		t.Fatal("expected the subnets allowed, got", subnets, err)
+	}
+	if _, err := s.checkSubnets([]string{"192.168.1.0/24"}); !errors.Is(err, ErrPolicyDenied) {
+		t.Fatal("expected a subnet outside of the allowlist, got", err)
+	}
+	for _, val := range [][]string{
+		{"172.16.3.1/24"},
+		// an enrolled peer, a merged peer, the interface network and another of the request
+		{"172.16.1.128/25"},
+		{"172.16.0.0/16"},
+		{"10.0.0.0/25"},
+		{"172.16.4.0/24", "172.16.4.0/23"},
+	} {
+		if _, err := s.checkSubnets(val); err == nil || errors.Is(err, ErrPolicyDenied) {
+			t.Fatal("expected", val, "rejected, got", err)
+		}
+	}
+
+	// pushed into the AllowedIPs of the others
+	s.pushSubnets = true
+	if ips, err := s.allowedIps(nil, ""); err != nil || !slices.Equal(ips, DefaultAllowedIps[:]) {
+		t.Fatal("expected the full tunnel to cover the subnets, got", ips, err)
+	}
+	s.routes = map[string][]string{models.RoutesVPN: {"10.0.0.0/24"}}
+	if ips, err := s.allowedIps(nil, models.RoutesVPN); err != nil || !slices.Equal(ips, []string{"10.0.0.0/24", "172.16.1.0/24"}) {
+		t.Fatal("expected the subnets pushed, got", ips, err)
+	}
+
+	// a rule limited to its route sets only gets the subnets inside them
+	s.routes["branches"] = []string{"172.16.0.0/16"}
+	rule := &policyRule{PolicyRule: models.PolicyRule{Name: "vpn only", Routes: []string{models.RoutesVPN}}}
+	if ips, err := s.allowedIps(rule, ""); err != nil || !slices.Equal(ips, []string{"10.0.0.0/24"}) {
+		t.Fatal("expected no subnets pushed past the rule, got", ips, err)
+	}
+	rule.Routes = []string{models.RoutesVPN, "branches"}
+	if ips, err := s.allowedIps(rule, models.RoutesVPN); err != nil || !slices.Equal(ips, []string{"10.0.0.0/24", "172.16.1.0/24"}) {
+		t.Fatal("expected the subnet inside the rule's sets pushed, got", ips, err)
+	}
+}
+
+func TestAddKeyPeerName(t *testing.T) {
+	s := testStore(t)
+	// whatever the client toml has, the comment quotes it
+	for i, name := range []string{"", "my laptop", "kitchen's Pixel 📱", strings.Repeat("a", maxPeerNameLen)} {
+		if _, err := s.AddKey(testEnroll(byte(i*2+1), name), Requester{Subject: "CN=test"}); err != nil {
+			t.Fatal("expected", name, "accepted, got", err)
+		}
+	}
+	if len(s.records) != 4 || s.records[2].Name != "kitchen's Pixel 📱" {
+		t.Fatal("unexpected records", s.records)
+	}
+	for _, name := range []string{"two\nlines", "tab\there", strings.Repeat("a", maxPeerNameLen+1), "\xff"} {
+		if _, err := s.AddKey(testEnroll(101, name), Requester{}); err == nil || !strings.Contains(err.Error(), "peer name") {
+			t.Fatal("expected", name, "rejected, got", err)
+		}
+	}
+}
+
+func TestKeepKeyFile(t *testing.T) {
+	keyPath := path.Join(t.TempDir(), "wgtest.key")
+	priv := must(ecdh.X25519().NewPrivateKey(bytes.Repeat([]byte{1}, 32)))
+	if err := keepKeyFile(keyPath, priv); err != nil {
+		t.Fatal(err)
+	}
+	// what a start without merging loads
+	if loaded, err := loadOrCreateKey(keyPath); err != nil || !loaded.Equal(priv) {
+		t.Fatal("expected the kept key, got", err)
+	}
+	if err := keepKeyFile(keyPath, priv); err != nil {
+		t.Fatal("expected the same key accepted, got", err)
+	}
+	other := must(ecdh.X25519().NewPrivateKey(bytes.Repeat([]byte{2}, 32)))
+	if err := keepKeyFile(keyPath, other); err == nil {
+		t.Fatal("expected a different key refused")
+	}
+}
+
+func TestRevokeKey(t *testing.T) {
+	s := testStore(t)
+	laptop := Requester{Subject: "CN=laptop"}
+	withPsk := testEnroll(1, "with-psk")
+	if _, err := s.AddKey(withPsk, laptop); err != nil {
+		t.Fatal(err)
+	}
+	noPsk := testEnroll(3, "no-psk")
+	noPsk.Psk = nil
+	if _, err := s.AddKey(noPsk, laptop); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.RevokeKey(testEnroll(5, "").Credentials, laptop); !errors.Is(err, ErrPeerNotFound) {
+		t.Fatal("expected an unknown key, got", err)
+	}
+	// the psk decides when there is one, not the subject
+	wrongPsk := models.Credentials{Pub: withPsk.Pub, Psk: bytes.Repeat([]byte{7}, 32)}
+	if err := s.RevokeKey(wrongPsk, laptop); !errors.Is(err, ErrForbidden) {
+		t.Fatal("expected a wrong psk refused, got", err)
+	}
+	if err := s.RevokeKey(models.Credentials{Pub: noPsk.Pub}, Requester{Subject: "CN=phone"}); !errors.Is(err, ErrForbidden) {
+		t.Fatal("expected another subject refused, got", err)
+	}
+	if len(s.records) != 2 {
+		t.Fatal("refused revocations changed the records", s.records)
+	}
+
+	if err := s.RevokeKey(models.Credentials{Pub: noPsk.Pub}, laptop); err != nil {
+		t.Fatal("expected the same subject allowed, got", err)
+	}
+	if err := s.RevokeKey(withPsk.Credentials, Requester{Subject: "CN=phone"}); err != nil {
+		t.Fatal("expected the right psk allowed, got", err)
+	}
+	if records, err := loadState(s.statePath); err != nil || len(records) != 0 || len(s.pubKeys) != 0 {
+		t.Fatal("revoked peers still persisted", records, err)
+	}
+
+	// the addresses are free again, the lowest one is handed out next
+	c, err := s.AddKey(testEnroll(9, "next"), laptop)
+	if err != nil || c.Intrfc.Address[0] != "10.0.0.2/24" {
+		t.Fatal("expected the released address handed out again, got", c, err)
+	}
+}
+
+func TestStateRoundTrip(t *testing.T) {
+	s := testStore(t)
+	for i, name := range []string{"laptop", "phone"} {
+		if _, err := s.AddKey(testEnroll(byte(i*2+1), name), Requester{Subject: "CN=" + name}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// what a restart does with the same state file
+	restored := testStore(t)
+	restored.statePath = s.statePath
+	if err := restored.restore(); err != nil {
+		t.Fatal(err)
+	}
+	if len(restored.pubKeys) != 2 || len(restored.processor.servConf.Peer) != 2 || !slices.EqualFunc(restored.records, s.records, func(a, b peerRecord) bool {
+		return a.Name == b.Name && bytes.Equal(a.Pub, b.Pub) && slices.Equal(a.Address, b.Address) && a.Subject == b.Subject
+	}) {
+		t.Fatal("state not restored:", restored.records)
+	}
+	if meta, ok := restored.processor.servConf.Peer[1].Meta(); !ok || meta.Name != "phone" {
+		t.Fatal("peer restored without its meta:", meta)
+	}
+	// restored keys and addresses are taken
+	if _, err := restored.AddKey(testEnroll(1, "again"), Requester{}); err == nil {
+		t.Fatal("expected a restored key refused")
+	}
+	c, err := restored.AddKey(testEnroll(5, "tablet"), Requester{})
+	if err != nil || c.Intrfc.Address[0] != "10.0.0.4/24" {
+		t.Fatal("expected the next free address, got", c, err)
+	}
+
+	// corrupt and duplicate states stop the start
+	corrupt := testStore(t)
+	if err := os.WriteFile(corrupt.statePath, []byte("{\"version\": 1, \"peers\": ["), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := corrupt.restore(); err == nil {
+		t.Fatal("expected a corrupt state rejected")
+	}
+	duplicate := testStore(t)
+	records := slices.Clone(s.records)
+	records[1].Pub = records[0].Pub
+	records[1].Address = []string{"10.0.0.9/24"}
+	if err := saveState(duplicate.statePath, records); err != nil {
+		t.Fatal(err)
+	}
+	if err := duplicate.restore(); err == nil {
+		t.Fatal("expected a duplicate key rejected")
+	}
+	collision := testStore(t)
+	records = slices.Clone(s.records)
+	records[1].Address = records[0].Address
+	if err := saveState(collision.statePath, records); err != nil {
+		t.Fatal(err)
+	}
+	if err := collision.restore(); err == nil {
+		t.Fatal("expected an address collision rejected")
+	}
+}
+
+func TestKeyFile(t *testing.T) {
+	servConf := models.WGEServer{IntrfcName: "wgtest", KeyFile: path.Join(t.TempDir(), "wgtest.key")}
+	keyPath := keyFilePath(servConf)
+
+	created, err := loadOrCreateKey(keyPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fstat, err := os.Stat(keyPath); err != nil || fstat.Mode().Perm() != keyFileMode {
+		t.Fatal("expected the key file created with", keyFileMode, "got", fstat, err)
+	}
+	if loaded, err := loadOrCreateKey(keyPath); err != nil || !loaded.Equal(created) {
+		t.Fatal("expected the same key loaded again, got", err)
+	}
+
+	if err := RotateKeyFile(servConf); err != nil {
+		t.Fatal(err)
+	}
+	rotated, err := loadOrCreateKey(keyPath)
+	if err != nil || rotated.Equal(created) {
+		t.Fatal("expected a new key after rotating, got", err)
+	}
+	if fstat, err := os.Stat(keyPath); err != nil || fstat.Mode().Perm() != keyFileMode {
+		t.Fatal("expected the rotated key file with", keyFileMode, "got", fstat, err)
+	}
+
+	// never overwritten when it can't be read as a key
+	for _, val := range []string{"not base64\n", base64.StdEncoding.EncodeToString([]byte("short")) + "\n"} {
+		if err := os.WriteFile(keyPath, []byte(val), keyFileMode); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := loadOrCreateKey(keyPath); err == nil {
+			t.Fatal("expected a malformed key file rejected:", val)
+		}
+		if buf, _ := os.ReadFile(keyPath); string(buf) != val {
+			t.Fatal("malformed key file overwritten")
+		}
+	}
+}
@@ -0,0 +1,58 @@
+package processor
+
+import (
+	"fmt"
+	"slices"
+)
+
+// the entry for val if there is one, the default otherwise
+func quotaLimit(limits map[string]int, fallback int, val string) int {
+	if limit, ok := limits[val]; ok {
+		return limit
+	}
+	// 0 is unlimited for the defaults only
+	if fallback == 0 {
+		return -1
+	}
+	return fallback
+}
+
+// Enrolled peers of the identity, and of every O and OU of it, have to stay under their quotas.
+// Only enrolled peers count, imported ones have no identity.
+func (s *Store) checkQuotas(req Requester) error {
+	type check struct {
+		kind   string
+		val    string
+		limit  int
+		holder func(r peerRecord) bool
+	}
+	checks := make([]check, 0, 1+len(req.Org)+len(req.OrgUnit))
+	if req.Subject != "" {
+		checks = append(checks, check{"identity", req.Subject, quotaLimit(s.quotas.Identities, s.quotas.PerIdentity, req.Subject),
+			func(r peerRecord) bool { return r.Subject == req.Subject }})
+	}
+	for _, val := range req.Org {
+		checks = append(checks, check{"O", val, quotaLimit(s.quotas.Orgs, s.quotas.PerOrg, val),
+			func(r peerRecord) bool { return slices.Contains(r.Org, val) }})
+	}
+	for _, val := range req.OrgUnit {
+		checks = append(checks, check{"OU", val, quotaLimit(s.quotas.OrgUnits, s.quotas.PerOrgUnit, val),
+			func(r peerRecord) bool { return slices.Contains(r.OrgUnit, val) }})
+	}
+
+	for _, val := range checks {
+		if val.limit < 0 {
+			continue
+		}
+		held := 0
+		for _, r := range s.records {
+			if val.holder(r) {
+				held += 1
+			}
+		}
+		if held >= val.limit {
+			return fmt.Errorf("%w: %s %q already holds %d of %d peers, revoke one first", ErrOverQuota, val.kind, val.val, held, val.limit)
+		}
+	}
+	return nil
+}
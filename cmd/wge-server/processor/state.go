@@ -0,0 +1,141 @@
+package processor
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"time"
+
+	"wg-exchange/models"
+)
+
+const (
+	defaultStatePath = "/var/lib/wg-exchange/"
+	stateVersion     = 1
+)
+
+// Everything needed to regenerate a [Peer] block and to re-seed the Store after a restart
+type peerRecord struct {
+	Name       string     `json:"name,omitempty"`
+	Pub        models.Key `json:"publicKey"`
+	Psk        models.Key `json:"presharedKey,omitempty"`
+	Address    []string   `json:"address"`
+	Ips        []string   `json:"allowedIPs"`
+	Enrolled   time.Time  `json:"enrolled"`
+	Subject    string     `json:"subject,omitempty"`
+	RemoteAddr string     `json:"remoteAddr,omitempty"`
+	// the rest of the verified client cert, the enrollment is bound to it
+	Org         []string `json:"org,omitempty"`
+	OrgUnit     []string `json:"orgUnit,omitempty"`
+	SANs        []string `json:"sans,omitempty"`
+	Fingerprint string   `json:"fingerprint,omitempty"`
+	// policy rule the enrollment matched
+	Rule string `json:"rule,omitempty"`
+	// routed to the peer, also in Ips
+	Subnets []string `json:"subnets,omitempty"`
+}
+
+type stateFile struct {
+	Version int          `json:"version"`
+	Peers   []peerRecord `json:"peers"`
+}
+
+// Where the request came from and the verified leaf cert it came with, recorded with each enrollment
+type Requester struct {
+	Subject    string
+	CommonName string
+	RemoteAddr string
+	Org        []string
+	OrgUnit    []string
+	// DNS:, email:, IP: and URI: prefixed
+	SANs []string
+	// base64 sha256 of the SubjectPublicKeyInfo
+	Fingerprint string
+}
+
+func (r peerRecord) peer() models.Peer {
+	peer := models.Peer{
+		Ips: r.Ips,
+		Credentials: models.Credentials{
+			Pub: r.Pub,
+			Psk: r.Psk,
+		},
+	}
+	peer.SetMeta(models.PeerMeta{Name: r.Name, Cert: r.Subject, Enrolled: r.Enrolled})
+	return peer
+}
+
+func (r peerRecord) info() models.PeerInfo {
+	return models.PeerInfo{
+		Name:        r.Name,
+		PublicKey:   r.Pub,
+		Address:     r.Address,
+		Enrolled:    r.Enrolled,
+		Subject:     r.Subject,
+		RemoteAddr:  r.RemoteAddr,
+		SANs:        r.SANs,
+		Fingerprint: r.Fingerprint,
+		Subnets:     r.Subnets,
+	}
+}
+
+func stateFilePath(servConf models.WGEServer) string {
+	if servConf.StateFile != "" {
+		return servConf.StateFile
+	}
+	return path.Join(defaultStatePath, fmt.Sprintf("%s.json", servConf.IntrfcName))
+}
+
+// missing state file is not an error, it's just a fresh start
+func loadState(statePath string) ([]peerRecord, error) {
+	buf, err := os.ReadFile(statePath)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var state stateFile
+	if err := json.Unmarshal(buf, &state); err != nil {
+		return nil, err
+	}
+	if state.Version != stateVersion {
+		return nil, fmt.Errorf("unsupported state version %d", state.Version)
+	}
+	return state.Peers, nil
+}
+
+// write to a temp file and rename over, so a crash never leaves a half written state behind
+func saveState(statePath string, records []peerRecord) error {
+	buf, err := json.MarshalIndent(stateFile{Version: stateVersion, Peers: records}, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(path.Dir(statePath), 0o700); err != nil {
+		return err
+	}
+
+	// contains preshared keys, keep it private
+	f, err := os.CreateTemp(path.Dir(statePath), fmt.Sprintf(".%s-*", path.Base(statePath)))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	if _, err := f.Write(buf); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), statePath)
+}
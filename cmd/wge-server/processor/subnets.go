@@ -0,0 +1,68 @@
+package processor
+
+import (
+	"fmt"
+	"net/netip"
+	"slices"
+)
+
+// Networks behind the enrolling peer, routed to it by the server. They have to be within the RoutedSubnets
+// of the server and can't overlap the interface networks, each other or anything another peer is routed.
+func (s *Store) checkSubnets(subnets []string) ([]netip.Prefix, error) {
+	if len(subnets) == 0 {
+		return nil, nil
+	}
+	if len(s.routedSubnets) == 0 {
+		return nil, fmt.Errorf("%w, no routed subnets allowed", ErrPolicyDenied)
+	}
+
+	taken := make([]netip.Prefix, 0, len(s.netIps)+len(s.records))
+	for _, val := range s.netIps {
+		taken = append(taken, val.Masked())
+	}
+	for _, val := range s.records {
+		taken = appendPrefixes(taken, val.Ips)
+	}
+	for _, val := range s.imported {
+		taken = appendPrefixes(taken, val.Address)
+	}
+
+	rv := make([]netip.Prefix, 0, len(subnets))
+	for _, val := range subnets {
+		prefix, err := netip.ParsePrefix(val)
+		if err != nil {
+			return nil, fmt.Errorf("invalid subnet %q", val)
+		}
+		if prefix != prefix.Masked() {
+			return nil, fmt.Errorf("subnet %s has host bits set, expected %s", prefix, prefix.Masked())
+		}
+		if !slices.ContainsFunc(s.routedSubnets, func(p netip.Prefix) bool { return p.Bits() <= prefix.Bits() && p.Contains(prefix.Addr()) }) {
+			return nil, fmt.Errorf("%w, subnet %s outside of the routed subnets", ErrPolicyDenied, prefix)
+		}
+		if idx := slices.IndexFunc(taken, prefix.Overlaps); idx != -1 {
+			return nil, fmt.Errorf("subnet %s overlaps %s", prefix, taken[idx])
+		}
+		taken = append(taken, prefix)
+		rv = append(rv, prefix)
+	}
+	return rv, nil
+}
+
+// routes written by this server, anything unparseable was rejected before it got in
+func appendPrefixes(prefixes []netip.Prefix, vals []string) []netip.Prefix {
+	for _, val := range vals {
+		if prefix, err := netip.ParsePrefix(val); err == nil {
+			prefixes = append(prefixes, prefix.Masked())
+		}
+	}
+	return prefixes
+}
+
+// subnets of the enrolled site peers, for the AllowedIPs of the others
+func (s *Store) pushedSubnets() []string {
+	var rv []string
+	for _, val := range s.records {
+		rv = append(rv, val.Subnets...)
+	}
+	return rv
+}
@@ -2,11 +2,16 @@ package server
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/base64"
 	"encoding/gob"
+	"encoding/json"
 	"errors"
+	"fmt"
 	"log"
 	"net/http"
 	"net/netip"
+	"slices"
 
 	"wg-exchange/cmd"
 	"wg-exchange/cmd/wge-server/processor"
@@ -15,27 +20,40 @@ import (
 )
 
 type Server struct {
-	store  *processor.Store
-	server *http.Server
+	store         *processor.Store
+	server        *http.Server
+	adminSubjects []string
 }
 
-func (s *Server) addPeer(w http.ResponseWriter, r *http.Request) {
-	defer r.Body.Close()
-	var creds models.Credentials
-	log.Println("[Request] addr:", r.RemoteAddr, ", user-agent:", r.UserAgent())
+// gob encoded request bodies
+func decodeBody[T any](w http.ResponseWriter, r *http.Request) (creds T, ok bool) {
+	log.Println("[Request]", r.Method, "addr:", r.RemoteAddr, ", user-agent:", r.UserAgent())
 	if r.Header.Get("Content-Type") != "application/octet-stream" {
 		log.Println("unsupported media type")
 		http.Error(w, "unsupported media type", http.StatusUnsupportedMediaType)
-		return
+		return creds, false
 	}
 	if err := gob.NewDecoder(r.Body).Decode(&creds); err != nil {
 		log.Println("decode failure:", err)
 		http.Error(w, "bad request", http.StatusBadRequest)
+		return creds, false
+	}
+	return creds, true
+}
+
+func (s *Server) addPeer(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	enroll, ok := decodeBody[models.EnrollRequest](w, r)
+	if !ok {
 		return
 	}
-	if c, err := s.store.AddKey(creds); err != nil {
+	if c, err := s.store.AddKey(enroll, requester(r)); err != nil {
 		log.Println("addKey failure:", err)
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		if errors.Is(err, processor.ErrOverQuota) || errors.Is(err, processor.ErrPolicyDenied) {
+			http.Error(w, err.Error(), http.StatusForbidden)
+		} else {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+		}
 		return
 	} else {
 		// explicit, unnecessary
@@ -48,6 +66,81 @@ func (s *Server) addPeer(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+func (s *Server) revokePeer(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	creds, ok := decodeBody[models.Credentials](w, r)
+	if !ok {
+		return
+	}
+	if err := s.store.RevokeKey(creds, requester(r)); err != nil {
+		log.Println("revokeKey failure:", err)
+		switch {
+		case errors.Is(err, processor.ErrPeerNotFound):
+			http.Error(w, err.Error(), http.StatusNotFound)
+		case errors.Is(err, processor.ErrForbidden):
+			http.Error(w, err.Error(), http.StatusForbidden)
+		default:
+			http.Error(w, err.Error(), http.StatusBadRequest)
+		}
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+	log.Println("successfully revoked peer")
+}
+
+// read only, json so that it can be consumed by something other than wge-client too
+func (s *Server) listPeers(w http.ResponseWriter, r *http.Request) {
+	req := requester(r)
+	log.Println("[Request]", r.Method, "addr:", r.RemoteAddr, ", user-agent:", r.UserAgent())
+	// every enrolled cert can reach this, so nobody may list without AdminSubjects
+	if !slices.Contains(s.adminSubjects, req.Subject) {
+		log.Println("listing not allowed for:", req.Subject)
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return
+	}
+
+	query := r.URL.Query()
+	peers := s.store.List(query.Get("name"), query.Get("subject"))
+
+	w.Header().Add("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(peers); err != nil {
+		log.Println("error encoding")
+		http.Error(w, "error encoding", http.StatusInternalServerError)
+	}
+}
+
+// leaf of the verified chain, RequireAndVerifyClientCert makes sure there is one
+func requester(r *http.Request) processor.Requester {
+	req := processor.Requester{
+		RemoteAddr: r.RemoteAddr,
+	}
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return req
+	}
+
+	leaf := r.TLS.VerifiedChains[0][0]
+	req.Subject = leaf.Subject.String()
+	req.CommonName = leaf.Subject.CommonName
+	req.Org = leaf.Subject.Organization
+	req.OrgUnit = leaf.Subject.OrganizationalUnit
+	for _, val := range leaf.DNSNames {
+		req.SANs = append(req.SANs, "DNS:"+val)
+	}
+	for _, val := range leaf.EmailAddresses {
+		req.SANs = append(req.SANs, "email:"+val)
+	}
+	for _, val := range leaf.IPAddresses {
+		req.SANs = append(req.SANs, "IP:"+val.String())
+	}
+	for _, val := range leaf.URIs {
+		req.SANs = append(req.SANs, "URI:"+val.String())
+	}
+	// survives a reissue of the cert with the same key, unlike the cert fingerprint
+	sum := sha256.Sum256(leaf.RawSubjectPublicKeyInfo)
+	req.Fingerprint = base64.StdEncoding.EncodeToString(sum[:])
+	return req
+}
+
 func (s *Server) StartServer(ctx context.Context, cancel context.CancelFunc) {
 	go s.listen(ctx, cancel)
 
@@ -82,7 +175,8 @@ func NewServer(wgeServConf models.WGEServer, store *processor.Store, certPath st
 
 	mux := http.NewServeMux()
 	serv = &Server{
-		store: store,
+		store:         store,
+		adminSubjects: wgeServConf.AdminSubjects,
 		server: &http.Server{
 			Addr:      addr.String(),
 			Handler:   mux,
@@ -91,6 +185,8 @@ func NewServer(wgeServConf models.WGEServer, store *processor.Store, certPath st
 		},
 	}
 	mux.HandleFunc(cmd.AddPeerPath, serv.addPeer)
+	mux.HandleFunc(fmt.Sprintf("%s %s", http.MethodDelete, cmd.PeersPath), serv.revokePeer)
+	mux.HandleFunc(fmt.Sprintf("%s %s", http.MethodGet, cmd.PeersPath), serv.listPeers)
 
 	terminator.HookInto(serv.StartServer)
 
@@ -0,0 +1,90 @@
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"path"
+	"testing"
+
+	"wg-exchange/cmd/wge-server/processor"
+	"wg-exchange/cmd/wge-server/service"
+	"wg-exchange/models"
+)
+
+// a store in temp dirs with the dry-run backend, enrolled entries are never processed
+func testStore(t *testing.T) *processor.Store {
+	dir := t.TempDir()
+	store, err := processor.NewStore(models.WGEServerConf{
+		Server: models.WGEServer{
+			IntrfcName:        "wgetest",
+			WireguardEndpoint: netip.MustParseAddrPort("127.0.0.1:51820"),
+			WireguardDns:      []netip.Addr{netip.MustParseAddr("10.0.0.1")},
+			ServiceManager:    service.BackendDryRun,
+			WireguardPath:     dir,
+			StateFile:         path.Join(dir, "state.json"),
+			HistoryDir:        path.Join(dir, "history"),
+		},
+		WgInterface: models.Interface{Address: []string{"10.0.0.1/24"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return store
+}
+
+func listRequest(subject string, query string) *http.Request {
+	r := httptest.NewRequest(http.MethodGet, "/peers"+query, nil)
+	leaf := &x509.Certificate{Subject: pkix.Name{CommonName: subject, Organization: []string{"Test"}}}
+	r.TLS = &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{leaf}}}
+	return r
+}
+
+func TestListPeers(t *testing.T) {
+	store := testStore(t)
+	for i, name := range []string{"laptop", "phone"} {
+		creds := models.Credentials{Pub: make([]byte, 32)}
+		creds.Pub[0] = byte(i + 1)
+		req := processor.Requester{Subject: "CN=" + name + ",O=Test"}
+		if _, err := store.AddKey(models.EnrollRequest{Credentials: creds, Name: name}, req); err != nil {
+			t.Fatal(err)
+		}
+	}
+	list := func(s *Server, r *http.Request) (int, []models.PeerInfo) {
+		w := httptest.NewRecorder()
+		s.listPeers(w, r)
+		var peers []models.PeerInfo
+		if w.Code == http.StatusOK {
+			if err := json.NewDecoder(w.Body).Decode(&peers); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return w.Code, peers
+	}
+
+	// nobody lists without AdminSubjects
+	if code, _ := list(&Server{store: store}, listRequest("admin", "")); code != http.StatusForbidden {
+		t.Fatal("expected listing denied without AdminSubjects, got", code)
+	}
+
+	s := &Server{store: store, adminSubjects: []string{"CN=admin,O=Test"}}
+	if code, _ := list(s, listRequest("laptop", "")); code != http.StatusForbidden {
+		t.Fatal("expected a non admin cert denied, got", code)
+	}
+	if code, peers := list(s, listRequest("admin", "")); code != http.StatusOK || len(peers) != 2 {
+		t.Fatal("expected every peer for the admin, got", code, peers)
+	}
+	if code, peers := list(s, listRequest("admin", "?name=phone")); code != http.StatusOK || len(peers) != 1 || peers[0].Name != "phone" {
+		t.Fatal("expected the name filter, got", code, peers)
+	}
+	if code, peers := list(s, listRequest("admin", "?subject=CN%3Dlaptop")); code != http.StatusOK || len(peers) != 1 || peers[0].Name != "laptop" {
+		t.Fatal("expected the subject filter, got", code, peers)
+	}
+	if code, peers := list(s, listRequest("admin", "?name=tablet")); code != http.StatusOK || len(peers) != 0 {
+		t.Fatal("expected nothing listed, got", code, peers)
+	}
+}
@@ -0,0 +1,26 @@
+package service
+
+import "log"
+
+// Only logs, for running without touching the system
+type DryRunManager struct{}
+
+func (DryRunManager) EnableAndStartService(intrfc string) error {
+	log.Println("dry-run enable and start service:", intrfc)
+	return nil
+}
+
+func (DryRunManager) RestartService(intrfc string) error {
+	log.Println("dry-run restart service:", intrfc)
+	return nil
+}
+
+func (DryRunManager) StopService(intrfc string) error {
+	log.Println("dry-run stop service:", intrfc)
+	return nil
+}
+
+func (DryRunManager) DisableAndStopService(intrfc string) error {
+	log.Println("dry-run disable and stop service:", intrfc)
+	return nil
+}
@@ -0,0 +1,122 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"os/exec"
+	"sync"
+	"time"
+)
+
+const (
+	execTimeout         = 30 * time.Second
+	openRCServiceFormat = "wg-quick.%s"
+	openRCRunlevel      = "default"
+)
+
+// swapped out in tests
+var run = runCommand
+
+// runs a single command, the output is only surfaced on failure
+func runCommand(name string, args ...string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), execTimeout)
+	defer cancel()
+
+	out, err := exec.CommandContext(ctx, name, args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%s %v: %w: %s", name, args, err, bytes.TrimSpace(out))
+	}
+	log.Println("ran:", name, args)
+	return nil
+}
+
+/** --- wg-quick --- */
+
+// wg-quick directly, nothing is enabled so the interface won't come back on boot by itself
+type WgQuickManager struct {
+	m sync.Mutex
+}
+
+func (w *WgQuickManager) EnableAndStartService(intrfc string) error {
+	w.m.Lock()
+	defer w.m.Unlock()
+
+	// wg-quick up refuses existing interfaces, take it down first so the fresh conf is applied
+	if _, err := net.InterfaceByName(intrfc); err == nil {
+		if err := run("wg-quick", "down", intrfc); err != nil {
+			return err
+		}
+	}
+	return run("wg-quick", "up", intrfc)
+}
+
+func (w *WgQuickManager) RestartService(intrfc string) error {
+	w.m.Lock()
+	defer w.m.Unlock()
+
+	if err := run("wg-quick", "down", intrfc); err != nil {
+		return err
+	}
+	return run("wg-quick", "up", intrfc)
+}
+
+func (w *WgQuickManager) StopService(intrfc string) error {
+	w.m.Lock()
+	defer w.m.Unlock()
+	return run("wg-quick", "down", intrfc)
+}
+
+// nothing to disable, same as stopping
+func (w *WgQuickManager) DisableAndStopService(intrfc string) error {
+	w.m.Lock()
+	defer w.m.Unlock()
+	return run("wg-quick", "down", intrfc)
+}
+
+/** --- openrc --- */
+
+// expects the usual wg-quick.<intrfc> symlink to the wg-quick init script
+type OpenRCManager struct {
+	m sync.Mutex
+}
+
+func (o *OpenRCManager) EnableAndStartService(intrfc string) error {
+	o.m.Lock()
+	defer o.m.Unlock()
+
+	service := fmt.Sprintf(openRCServiceFormat, intrfc)
+	if err := run("rc-update", "add", service, openRCRunlevel); err != nil {
+		return err
+	}
+	// start does nothing for a started service, it has to be restarted to pick up the rewritten conf
+	if err := run("rc-service", service, "status"); err == nil {
+		return run("rc-service", service, "restart")
+	}
+	return run("rc-service", service, "start")
+}
+
+func (o *OpenRCManager) RestartService(intrfc string) error {
+	o.m.Lock()
+	defer o.m.Unlock()
+	return run("rc-service", fmt.Sprintf(openRCServiceFormat, intrfc), "restart")
+}
+
+func (o *OpenRCManager) StopService(intrfc string) error {
+	o.m.Lock()
+	defer o.m.Unlock()
+	return run("rc-service", fmt.Sprintf(openRCServiceFormat, intrfc), "stop")
+}
+
+func (o *OpenRCManager) DisableAndStopService(intrfc string) error {
+	o.m.Lock()
+	defer o.m.Unlock()
+
+	service := fmt.Sprintf(openRCServiceFormat, intrfc)
+	if err := run("rc-service", service, "stop"); err != nil {
+		return err
+	}
+	return run("rc-update", "del", service, openRCRunlevel)
+}
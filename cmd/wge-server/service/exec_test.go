@@ -0,0 +1,41 @@
+package service
+
+import (
+	"errors"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestOpenRCEnableAndStart(t *testing.T) {
+	var ran []string
+	started := false
+	run = func(name string, args ...string) error {
+		cmd := strings.Join(append([]string{name}, args...), " ")
+		ran = append(ran, cmd)
+		if cmd == "rc-service wg-quick.wgtest status" && !started {
+			return errors.New("status: stopped")
+		}
+		return nil
+	}
+	t.Cleanup(func() { run = runCommand })
+
+	o := &OpenRCManager{}
+	if err := o.EnableAndStartService("wgtest"); err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"rc-update add wg-quick.wgtest default", "rc-service wg-quick.wgtest status", "rc-service wg-quick.wgtest start"}
+	if !slices.Equal(ran, expected) {
+		t.Fatal("unexpected commands for a stopped service:", ran)
+	}
+
+	// already started, restarted so the conf goes live
+	ran, started = nil, true
+	if err := o.EnableAndStartService("wgtest"); err != nil {
+		t.Fatal(err)
+	}
+	expected[2] = "rc-service wg-quick.wgtest restart"
+	if !slices.Equal(ran, expected) {
+		t.Fatal("unexpected commands for a started service:", ran)
+	}
+}
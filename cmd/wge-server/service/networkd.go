@@ -0,0 +1,87 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"net"
+	"os"
+	"path"
+	"sync"
+	"time"
+
+	dbusclient "wg-exchange/cmd/wge-server/dbus_client"
+	netlinkclient "wg-exchange/cmd/wge-server/netlink_client"
+)
+
+const (
+	linkTimeout  = 30 * time.Second
+	linkPollWait = 200 * time.Millisecond
+)
+
+// systemd-networkd, the <intrfc>.netdev/.network pair in confDir is the conf and it's brought up on boot by itself.
+// A reload leaves existing netdevs as they are, so the link is deleted first and networkd creates it again from the fresh .netdev
+type NetworkdManager struct {
+	m       sync.Mutex
+	confDir string
+}
+
+// the reload returns before the link exists, a .netdev networkd refuses never shows up
+func waitForLink(intrfc string) error {
+	deadline := time.Now().Add(linkTimeout)
+	for time.Now().Before(deadline) {
+		if _, err := net.InterfaceByName(intrfc); err == nil {
+			return nil
+		}
+		time.Sleep(linkPollWait)
+	}
+	return fmt.Errorf("networkd didn't create %s, see networkctl status %s", intrfc, intrfc)
+}
+
+func (n *NetworkdManager) recreate(intrfc string) error {
+	if err := netlinkclient.DeleteLink(intrfc); err != nil {
+		return err
+	}
+	if err := dbusclient.ReloadNetworkd(); err != nil {
+		return err
+	}
+	log.Println("reloaded networkd:", intrfc)
+	return waitForLink(intrfc)
+}
+
+// nothing to enable, networkd picks up the files in /etc/systemd/network on boot
+func (n *NetworkdManager) EnableAndStartService(intrfc string) error {
+	n.m.Lock()
+	defer n.m.Unlock()
+	return n.recreate(intrfc)
+}
+
+func (n *NetworkdManager) RestartService(intrfc string) error {
+	n.m.Lock()
+	defer n.m.Unlock()
+	return n.recreate(intrfc)
+}
+
+// back on the next reload or boot
+func (n *NetworkdManager) StopService(intrfc string) error {
+	n.m.Lock()
+	defer n.m.Unlock()
+	return netlinkclient.DeleteLink(intrfc)
+}
+
+// the files are removed so it stays down, the server writes them again on its next start
+func (n *NetworkdManager) DisableAndStopService(intrfc string) error {
+	n.m.Lock()
+	defer n.m.Unlock()
+
+	for _, ext := range []string{".netdev", ".network"} {
+		if err := os.Remove(path.Join(n.confDir, intrfc+ext)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+	}
+	if err := dbusclient.ReloadNetworkd(); err != nil {
+		return err
+	}
+	return netlinkclient.DeleteLink(intrfc)
+}
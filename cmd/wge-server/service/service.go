@@ -0,0 +1,68 @@
+// service manager backends that bring the wireguard interface up and down
+package service
+
+import (
+	"fmt"
+	"slices"
+
+	dbusclient "wg-exchange/cmd/wge-server/dbus_client"
+)
+
+const (
+	BackendSystemd  = "systemd"
+	BackendWgQuick  = "wg-quick"
+	BackendOpenRC   = "openrc"
+	BackendNetworkd = "networkd"
+	BackendDryRun   = "dry-run"
+
+	DefaultBackend = BackendDryRun
+
+	// what happens to the interface when the server stops
+	ShutdownKeep    = "keep"
+	ShutdownDown    = "down"
+	ShutdownDisable = "disable"
+
+	DefaultShutdown = ShutdownKeep
+)
+
+var (
+	Backends         = [...]string{BackendSystemd, BackendWgQuick, BackendOpenRC, BackendNetworkd, BackendDryRun}
+	ShutdownPolicies = [...]string{ShutdownKeep, ShutdownDown, ShutdownDisable}
+)
+
+type Options struct {
+	// systemd only, the enable is dropped on reboot
+	RuntimeEnable bool
+	// networkd only, where the .netdev/.network are written
+	ConfDir string
+}
+
+// All of these are called with the interface conf already written
+type Manager interface {
+	EnableAndStartService(intrfc string) error
+	RestartService(intrfc string) error
+	StopService(intrfc string) error
+	DisableAndStopService(intrfc string) error
+}
+
+func New(backend string, opts Options) (Manager, error) {
+	switch backend {
+	case BackendSystemd:
+		dbusclient.DefaultSystemdManager.SetRuntimeEnable(opts.RuntimeEnable)
+		return dbusclient.DefaultSystemdManager, nil
+	case BackendWgQuick:
+		return &WgQuickManager{}, nil
+	case BackendOpenRC:
+		return &OpenRCManager{}, nil
+	case BackendNetworkd:
+		return &NetworkdManager{confDir: opts.ConfDir}, nil
+	case BackendDryRun, "":
+		return &DryRunManager{}, nil
+	default:
+		return nil, fmt.Errorf("unknown service manager %q, expected one of %v", backend, Backends)
+	}
+}
+
+func ValidShutdownPolicy(policy string) bool {
+	return policy == "" || slices.Contains(ShutdownPolicies[:], policy)
+}
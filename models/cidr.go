@@ -0,0 +1,109 @@
+// AllowedIPs arithmetic, wg-quick has no way of saying everything but some ranges
+package models
+
+import (
+	"net/netip"
+	"slices"
+)
+
+// The addresses of include not in exclude, as the fewest prefixes covering exactly those.
+// v4 and v6 are worked out separately, excludes of the other family change nothing.
+func SubtractPrefixes(include []netip.Prefix, exclude []netip.Prefix) []netip.Prefix {
+	rv := make([]netip.Prefix, 0, len(include))
+	for _, val := range include {
+		rv = append(rv, val.Masked())
+	}
+	for _, ex := range exclude {
+		ex = ex.Masked()
+		var next []netip.Prefix
+		for _, val := range rv {
+			next = append(next, subtractPrefix(val, ex)...)
+		}
+		rv = next
+	}
+	return aggregatePrefixes(rv)
+}
+
+// Same as SubtractPrefixes on the string notation of AllowedIPs
+func SubtractAllowedIps(include []string, exclude []string) ([]string, error) {
+	parse := func(vals []string) ([]netip.Prefix, error) {
+		rv := make([]netip.Prefix, 0, len(vals))
+		for _, val := range vals {
+			prefix, err := netip.ParsePrefix(val)
+			if err != nil {
+				return nil, &InvalidValueError{Field: "AllowedIPs", Value: val, Err: err}
+			}
+			rv = append(rv, prefix)
+		}
+		return rv, nil
+	}
+	in, err := parse(include)
+	if err != nil {
+		return nil, err
+	}
+	ex, err := parse(exclude)
+	if err != nil {
+		return nil, err
+	}
+
+	prefixes := SubtractPrefixes(in, ex)
+	rv := make([]string, 0, len(prefixes))
+	for _, val := range prefixes {
+		rv = append(rv, val.String())
+	}
+	return rv, nil
+}
+
+// p without ex, p halved down to ex's size where they overlap
+func subtractPrefix(p netip.Prefix, ex netip.Prefix) []netip.Prefix {
+	if !p.Overlaps(ex) {
+		return []netip.Prefix{p}
+	}
+	if ex.Bits() <= p.Bits() {
+		return nil
+	}
+	low, high := halves(p)
+	return append(subtractPrefix(low, ex), subtractPrefix(high, ex)...)
+}
+
+func halves(p netip.Prefix) (netip.Prefix, netip.Prefix) {
+	bits := p.Bits()
+	addr := p.Addr().AsSlice()
+	addr[bits/8] |= 0x80 >> (bits % 8)
+	high, _ := netip.AddrFromSlice(addr)
+	return netip.PrefixFrom(p.Addr(), bits+1), netip.PrefixFrom(high, bits+1)
+}
+
+// sorted, without prefixes inside others, and sibling halves joined back until none are left
+func aggregatePrefixes(prefixes []netip.Prefix) []netip.Prefix {
+	slices.SortFunc(prefixes, func(a, b netip.Prefix) int {
+		if c := a.Addr().Compare(b.Addr()); c != 0 {
+			return c
+		}
+		return a.Bits() - b.Bits()
+	})
+	rv := make([]netip.Prefix, 0, len(prefixes))
+	for _, val := range prefixes {
+		if len(rv) != 0 && rv[len(rv)-1].Contains(val.Addr()) && rv[len(rv)-1].Bits() <= val.Bits() {
+			continue
+		}
+		rv = append(rv, val)
+	}
+
+	for joined := true; joined; {
+		joined = false
+		for i := 0; i+1 < len(rv); i++ {
+			a, b := rv[i], rv[i+1]
+			if a.Bits() != b.Bits() || a.Bits() == 0 {
+				continue
+			}
+			parent := netip.PrefixFrom(a.Addr(), a.Bits()-1).Masked()
+			if parent.Addr() != a.Addr() || !parent.Contains(b.Addr()) {
+				continue
+			}
+			rv = slices.Replace(rv, i, i+2, parent)
+			joined = true
+		}
+	}
+	return rv
+}
@@ -0,0 +1,52 @@
+package models
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestSubtractAllowedIps(t *testing.T) {
+	cases := []struct {
+		include, exclude, want []string
+	}{
+		{
+			[]string{"0.0.0.0/0"}, []string{"128.0.0.0/1"},
+			[]string{"0.0.0.0/1"},
+		},
+		{
+			[]string{"0.0.0.0/0", "::/0"}, []string{"192.168.0.0/16", "10.0.0.0/8", "fc00::/7"},
+			[]string{"0.0.0.0/5", "8.0.0.0/7", "11.0.0.0/8", "12.0.0.0/6", "16.0.0.0/4", "32.0.0.0/3", "64.0.0.0/2", "128.0.0.0/2",
+				"192.0.0.0/9", "192.128.0.0/11", "192.160.0.0/13", "192.169.0.0/16", "192.170.0.0/15", "192.172.0.0/14",
+				"192.176.0.0/12", "192.192.0.0/10", "193.0.0.0/8", "194.0.0.0/7", "196.0.0.0/6", "200.0.0.0/5", "208.0.0.0/4",
+				"224.0.0.0/3", "::/1", "8000::/2", "c000::/3", "e000::/4", "f000::/5", "f800::/6", "fe00::/7"},
+		},
+		// overlapping and adjacent includes are joined, excludes outside of them do nothing
+		{
+			[]string{"10.0.0.0/25", "10.0.0.128/25", "10.0.0.7/32", "fd00::/64"}, []string{"172.16.0.0/12", "fd00:1::/64"},
+			[]string{"10.0.0.0/24", "fd00::/64"},
+		},
+		{
+			[]string{"10.0.0.0/24"}, []string{"10.0.0.0/16"},
+			[]string{},
+		},
+		{
+			[]string{"10.0.0.0/30"}, []string{"10.0.0.1/32"},
+			[]string{"10.0.0.0/32", "10.0.0.2/31"},
+		},
+	}
+	for _, val := range cases {
+		got, err := SubtractAllowedIps(val.include, val.exclude)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, val.want) {
+			t.Errorf("%v - %v: expected %v, got %v", val.include, val.exclude, val.want, got)
+		}
+	}
+
+	var invalid *InvalidValueError
+	if _, err := SubtractAllowedIps([]string{"0.0.0.0/0"}, []string{"lan"}); !errors.As(err, &invalid) {
+		t.Fatal("expected an invalid value, got", err)
+	}
+}
@@ -6,52 +6,187 @@ import (
 	"encoding"
 	"encoding/base64"
 	"fmt"
-	"log"
+	"net"
+	"net/netip"
 	"reflect"
+	"strconv"
+	"strings"
+	"sync"
 )
 
 const (
 	nameTag       = "toml"
 	singleLineTag = "singleline"
+	verbatimTag   = "verbatim"
+	formatTag     = "format"
+	commentTag    = "comment"
+
+	// values checked before writing, see validateFormat
+	formatPrefix   = "prefix"
+	formatHostPort = "hostport"
+	formatTable    = "table"
+	// numbers where off means 0
+	formatOff = "off"
+
+	commentPrefix = "# "
+
+	keyLen = 32
 )
 
+// reflect.Type -> []Metadata, one per field
+var metadataCache sync.Map
+
+// Type that can't be written as conf, a bug in the models rather than bad input
+type UnsupportedTypeError struct {
+	Type  reflect.Type
+	Field string
+}
+
+func (e *UnsupportedTypeError) Error() string {
+	if e.Field == "" {
+		return fmt.Sprintf("unsupported type %s", e.Type)
+	}
+	return fmt.Sprintf("unsupported type %s of field %s", e.Type, e.Field)
+}
+
+// Value that wg wouldn't accept, Value is left empty for keys
+type InvalidValueError struct {
+	Field string
+	Value string
+	Err   error
+}
+
+func (e *InvalidValueError) Error() string {
+	if e.Value == "" {
+		return fmt.Sprintf("invalid %s: %v", e.Field, e.Err)
+	}
+	return fmt.Sprintf("invalid %s %q: %v", e.Field, e.Value, e.Err)
+}
+
+func (e *InvalidValueError) Unwrap() error {
+	return e.Err
+}
+
 type Metadata struct {
 	name            string
 	arrayKind       bool
 	encodeBase64    bool
 	singleArrayLine bool
+	verbatim        bool // never split on commas when parsing, hooks are whole commands
 	structKind      bool
 	anonField       bool
+	format          string
+	pointerKind     bool // unset when nil, written even if zero otherwise
+	comment         bool
 }
 
-func getMetaData(rsf reflect.StructField) (meta Metadata) {
+func isPrimitive(kind reflect.Kind) bool {
+	switch kind {
+	case reflect.String, reflect.Bool,
+		reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return true
+	}
+	return false
+}
+
+func getMetaData(rsf reflect.StructField) (meta Metadata, err error) {
 	rsfT := rsf.Type
 	meta.name = rsf.Tag.Get(nameTag)
 
 	if meta.name == "" {
 		meta.name = rsf.Name
 	}
-	// log.Println("name:", meta.name, "kind:", rsfT.Kind())
+	meta.format = rsf.Tag.Get(formatTag)
+	unsupported := &UnsupportedTypeError{Type: rsfT, Field: meta.name}
 
 	if rsfT.Kind() == reflect.Array || rsfT.Kind() == reflect.Slice {
 		meta.arrayKind = true
+		elemT := rsfT.Elem()
 
-		if rsfT.Elem().Kind() == reflect.String && rsf.Tag.Get(singleLineTag) == "true" {
+		if elemT.Kind() == reflect.String && rsf.Tag.Get(singleLineTag) == "true" {
 			meta.singleArrayLine = true
 		}
 
-		if rsfT.Elem().Kind() == reflect.Uint8 {
+		meta.verbatim = rsf.Tag.Get(verbatimTag) == "true"
+
+		if elemT.Kind() == reflect.Uint8 {
 			meta.encodeBase64 = true
+		} else if elemT.Kind() == reflect.Struct && !elemT.Implements(reflect.TypeFor[encoding.TextMarshaler]()) {
+			return meta, unsupported
+		} else if elemT.Kind() != reflect.Struct && !isPrimitive(elemT.Kind()) {
+			return meta, unsupported
 		}
 	} else if rsfT.Kind() == reflect.Struct {
 		meta.structKind = true
 		meta.anonField = rsf.Anonymous
 		if !(rsfT.Implements(reflect.TypeFor[encoding.TextMarshaler]())) {
-			log.Panicln("struct needs to implement TextMarshaler")
+			return meta, unsupported
+		}
+	} else if rsfT.Kind() == reflect.Pointer {
+		meta.pointerKind = true
+		if !isPrimitive(rsfT.Elem().Kind()) {
+			return meta, unsupported
 		}
+	} else if !isPrimitive(rsfT.Kind()) {
+		return meta, unsupported
 	}
 
-	return
+	if rsf.Tag.Get(commentTag) == "true" {
+		if rsfT.Kind() != reflect.String {
+			return meta, unsupported
+		}
+		meta.comment = true
+	}
+
+	return meta, nil
+}
+
+// field metadata of a struct type, reflected on once
+func typeMetaData(rvT reflect.Type) ([]Metadata, error) {
+	if cached, ok := metadataCache.Load(rvT); ok {
+		return cached.([]Metadata), nil
+	}
+	if rvT.Kind() != reflect.Struct {
+		return nil, &UnsupportedTypeError{Type: rvT}
+	}
+
+	metas := make([]Metadata, rvT.NumField())
+	for i := range metas {
+		meta, err := getMetaData(rvT.Field(i))
+		if err != nil {
+			return nil, err
+		}
+		metas[i] = meta
+	}
+	metadataCache.Store(rvT, metas)
+	return metas, nil
+}
+
+func validateFormat(meta Metadata, val string) error {
+	var err error
+	switch meta.format {
+	case formatPrefix:
+		_, err = netip.ParsePrefix(val)
+	case formatHostPort:
+		var host, port string
+		if host, port, err = net.SplitHostPort(val); err != nil {
+			break
+		}
+		if host == "" {
+			err = fmt.Errorf("missing host")
+		} else if num, perr := strconv.ParseUint(port, 10, 16); perr != nil || num == 0 {
+			err = fmt.Errorf("invalid port %q", port)
+		}
+	case formatTable:
+		if strings.ContainsAny(val, " \t") {
+			err = fmt.Errorf("expected off, auto or a routing table")
+		}
+	}
+	if err != nil {
+		return &InvalidValueError{Field: meta.name, Value: val, Err: err}
+	}
+	return nil
 }
 
 func writeBuffer(buffer *bytes.Buffer, buf []byte) error {
@@ -68,23 +203,60 @@ func writeBufferString(buffer *bytes.Buffer, str string) error {
 	return nil
 }
 
+func handleComment(buffer *bytes.Buffer, rv reflect.Value) error {
+	if rv.String() == "" {
+		return nil
+	}
+	for _, line := range strings.Split(rv.String(), "\n") {
+		if err := writeBufferString(buffer, commentPrefix+line+"\n"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// zero values are unset unless they come from a pointer
 func handlePrimitve(buffer *bytes.Buffer, rv reflect.Value, meta Metadata) error {
+	explicit := false
+	if rv.Kind() == reflect.Pointer {
+		if rv.IsNil() {
+			return nil
+		}
+		rv = rv.Elem()
+		explicit = true
+	}
+
 	switch rv.Kind() {
 	case reflect.String:
+		if meta.comment {
+			return handleComment(buffer, rv)
+		}
 		if rv.String() == "" {
 			return nil
 		}
+		if err := validateFormat(meta, rv.String()); err != nil {
+			return err
+		}
 		return writeBufferString(buffer, fmt.Sprintf("%s = %s\n", meta.name, rv.String()))
 	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
-		// skipping here if rv.Int() == 0 since fwMark as 0 seems to create problems in android-wireguard
-		if rv.Int() == 0 {
+		if rv.Int() == 0 && !explicit {
 			return nil
 		}
 		return writeBufferString(buffer, fmt.Sprintf("%s = %d\n", meta.name, rv.Int()))
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		// android-wireguard doesn't take FwMark at all, the android Platform leaves it out, see ForPlatform
+		if rv.Uint() == 0 && !explicit {
+			return nil
+		}
+		return writeBufferString(buffer, fmt.Sprintf("%s = %d\n", meta.name, rv.Uint()))
+	case reflect.Bool:
+		if !rv.Bool() && !explicit {
+			return nil
+		}
+		return writeBufferString(buffer, fmt.Sprintf("%s = %t\n", meta.name, rv.Bool()))
 	default:
-		log.Panicln("unkown primitive type")
+		return &UnsupportedTypeError{Type: rv.Type(), Field: meta.name}
 	}
-	return nil
 }
 
 func handleStruct(buffer *bytes.Buffer, rv reflect.Value, meta Metadata) error {
@@ -116,6 +288,9 @@ func handleSingleArrayString(buffer *bytes.Buffer, rv reflect.Value, meta Metada
 
 	for i := 0; i < rv.Len(); i++ {
 		str := rv.Index(i).String()
+		if err := validateFormat(meta, str); err != nil {
+			return err
+		}
 
 		if i == 0 {
 			if err := writeBufferString(buffer, str); err != nil {
@@ -131,6 +306,14 @@ func handleSingleArrayString(buffer *bytes.Buffer, rv reflect.Value, meta Metada
 }
 
 func handleByteArray(buffer *bytes.Buffer, rv reflect.Value, meta Metadata) error {
+	// an empty key line isn't valid for wg either
+	if rv.Len() == 0 {
+		return nil
+	}
+	if rv.Len() != keyLen {
+		return &InvalidValueError{Field: meta.name, Err: fmt.Errorf("expected %d bytes, got %d", keyLen, rv.Len())}
+	}
+
 	// can't convert to slice if unaddressable array... need to loop
 	var buf []byte
 	for i := 0; i < rv.Len(); i++ {
@@ -149,11 +332,7 @@ func handleArray(buffer *bytes.Buffer, rv reflect.Value, meta Metadata) error {
 		arrElemT := rv.Type().Elem()
 
 		if arrElemT.Kind() == reflect.Struct {
-			// struct type
-			if !arrElemT.Implements(reflect.TypeFor[encoding.TextMarshaler]()) {
-				log.Panicln("struct needs to implement TextMarshaler")
-			}
-
+			// struct type, checked to be a TextMarshaler in getMetaData
 			for i := 0; i < rv.Len(); i++ {
 				if err := handleStruct(buffer, rv.Index(i), meta); err != nil {
 					return err
@@ -173,34 +352,29 @@ func handleArray(buffer *bytes.Buffer, rv reflect.Value, meta Metadata) error {
 
 func confMarshallStruct(v any) (text []byte, err error) {
 	rv := reflect.ValueOf(v)
-	rvT := rv.Type()
-
-	if rv.Kind() == reflect.Struct {
-		var buffer bytes.Buffer
+	metas, err := typeMetaData(rv.Type())
+	if err != nil {
+		return nil, err
+	}
 
-		for i := 0; i < rv.NumField(); i++ {
-			val := rv.Field(i)
-			meta := getMetaData(rvT.Field(i))
-			if meta.arrayKind {
-				if err := handleArray(&buffer, val, meta); err != nil {
-					return nil, err
-				}
-			} else if meta.structKind {
-				if err := handleStruct(&buffer, val, meta); err != nil {
-					return nil, err
-				}
-			} else {
-				if err := handlePrimitve(&buffer, val, meta); err != nil {
-					return nil, err
-				}
+	var buffer bytes.Buffer
+	for i, meta := range metas {
+		val := rv.Field(i)
+		if meta.arrayKind {
+			if err := handleArray(&buffer, val, meta); err != nil {
+				return nil, err
+			}
+		} else if meta.structKind {
+			if err := handleStruct(&buffer, val, meta); err != nil {
+				return nil, err
+			}
+		} else {
+			if err := handlePrimitve(&buffer, val, meta); err != nil {
+				return nil, err
 			}
 		}
-		text = buffer.Bytes()
-	} else {
-		log.Panicln("only called on struct")
 	}
-	return
-
+	return buffer.Bytes(), nil
 }
 
 // --- TextMarshaler implemented by types ---
@@ -216,10 +390,6 @@ func (v Interface) MarshalText() (text []byte, err error) {
 	return confMarshallStruct(v)
 }
 
-func (v ServerInterface) MarshalText() (text []byte, err error) {
-	return confMarshallStruct(v)
-}
-
 func (v Config) MarshalText() (text []byte, err error) {
 	return confMarshallStruct(v)
 }
@@ -1,24 +1,27 @@
 package models
 
 import (
+	"errors"
 	"fmt"
+	"reflect"
+	"strings"
 	"testing"
 )
 
 const testConfVal = `[Interface]
-Address = 1.1.1.1
-Address = 1:1::1
+Address = 1.1.1.1/32
+Address = 1:1::1/128
 FwMark = 51820
 PrivateKey = AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA=
 
 [Peer]
-Endpoint = test
+Endpoint = test:51820
 AllowedIPs = 2.2.2.2/24, 2:2:2::2/120
 PublicKey = AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA=
 PresharedKey = AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA=
 
 [Peer]
-Endpoint = testing
+Endpoint = [::1]:51820
 PersistentKeepAlive = 12
 PublicKey = AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA=
 PresharedKey = AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA=
@@ -26,17 +29,19 @@ PresharedKey = AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA=
 `
 
 func TestBasicConfMarshalling(t *testing.T) {
+	fwMark := uint32(0x0000ca6c)
+	keepAlive := uint16(12)
 
 	testConf := ClientConfig{
 		Intrfc: Interface{
-			Address: []string{"1.1.1.1", "1:1::1"},
-			FwMark:  0x0000ca6c,
+			Address: []string{"1.1.1.1/32", "1:1::1/128"},
+			FwMark:  &fwMark,
 			Priv:    make([]byte, 32),
 		},
 		Config: Config{
 			Peer: []Peer{
 				{
-					Endpoint: "test",
+					Endpoint: "test:51820",
 					Ips:      []string{"2.2.2.2/24", "2:2:2::2/120"},
 					Credentials: Credentials{
 						Pub: make([]byte, 32),
@@ -44,8 +49,8 @@ func TestBasicConfMarshalling(t *testing.T) {
 					},
 				},
 				{
-					Endpoint:  "testing",
-					KeepAlive: 12,
+					Endpoint:  "[::1]:51820",
+					KeepAlive: &keepAlive,
 					Credentials: Credentials{
 						Pub: make([]byte, 32),
 						Psk: make([]byte, 32),
@@ -66,3 +71,203 @@ func TestBasicConfMarshalling(t *testing.T) {
 	}
 
 }
+
+func TestConfMarshallingErrors(t *testing.T) {
+	var invalid *InvalidValueError
+	for _, val := range []Peer{
+		{Endpoint: "test"},
+		{Endpoint: "test:0"},
+		{Endpoint: ":51820"},
+		{Ips: []string{"2.2.2.2"}},
+		{Credentials: Credentials{Pub: make([]byte, 31)}},
+	} {
+		if _, err := val.MarshalText(); !errors.As(err, &invalid) {
+			t.Errorf("%+v: expected an invalid value error, got %v", val, err)
+		}
+	}
+
+	var unsupported *UnsupportedTypeError
+	if _, err := confMarshallStruct(struct{ Valid []float64 }{}); !errors.As(err, &unsupported) {
+		t.Error("expected an unsupported type error, got", err)
+	}
+	if _, err := confMarshallStruct("test"); !errors.As(err, &unsupported) || unsupported.Type != reflect.TypeFor[string]() {
+		t.Error("expected an unsupported type error, got", err)
+	}
+}
+
+// pointers tell unset apart from zero, plain zero values are left out
+func TestConfMarshallingExplicitZero(t *testing.T) {
+	var zeroMark uint32
+	var zeroMTU uint16
+	saveConfig := false
+	intrfc := Interface{FwMark: &zeroMark, MTU: &zeroMTU, SaveConfig: &saveConfig, Table: "off"}
+
+	val, err := intrfc.MarshalText()
+	if err != nil {
+		t.Fatal("error:", err)
+	}
+	if string(val) != "FwMark = 0\nMTU = 0\nTable = off\nSaveConfig = false\n" {
+		t.Fatal("unexpected conf:\n", string(val))
+	}
+
+	if val, err := (Interface{}).MarshalText(); err != nil || len(val) != 0 {
+		t.Fatal("expected nothing for unset fields, got", string(val), err)
+	}
+}
+
+func TestForPlatform(t *testing.T) {
+	fwMark := uint32(51820)
+	mtu := uint16(1280)
+	conf := ClientConfig{
+		Intrfc: Interface{
+			Address: []string{"1.1.1.1/32"},
+			FwMark:  &fwMark,
+			MTU:     &mtu,
+			PreUp:   []string{"echo hello"},
+			Priv:    make([]byte, 32),
+		},
+		Config: Config{Peer: []Peer{{Endpoint: "test:51820", Credentials: Credentials{Pub: make([]byte, 32)}}}},
+	}
+
+	android, warnings, err := conf.ForPlatform(PlatformAndroid)
+	if err != nil {
+		t.Fatal("error:", err)
+	}
+	val, err := android.MarshalText()
+	if err != nil {
+		t.Fatal("error:", err)
+	}
+	if strings.Contains(string(val), "FwMark") || strings.Contains(string(val), "PreUp") || len(warnings) != 2 {
+		t.Fatal("unsupported keys not left out:", string(val), warnings)
+	}
+	// the original isn't touched
+	if conf.Intrfc.FwMark == nil || conf.Intrfc.PreUp == nil {
+		t.Fatal("original conf modified")
+	}
+
+	if linux, warnings, err := conf.ForPlatform(PlatformLinux); err != nil || len(warnings) != 0 || !reflect.DeepEqual(linux, conf) {
+		t.Fatal("expected the conf as is, got", linux, warnings, err)
+	}
+
+	var invalid *InvalidValueError
+	conf.Peer[0].Endpoint = ""
+	if _, _, err := conf.ForPlatform(PlatformIOS); !errors.As(err, &invalid) || invalid.Field != "Endpoint" {
+		t.Fatal("expected a missing endpoint, got", err)
+	}
+
+	var platform Platform
+	if err := platform.UnmarshalText([]byte("windows")); err == nil {
+		t.Fatal("expected an unknown platform")
+	}
+}
+
+const testNetdevVal = `[NetDev]
+Name=wg0
+Kind=wireguard
+MTUBytes=1420
+
+[WireGuard]
+PrivateKey=AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA=
+FirewallMark=51820
+RouteTable=51820
+
+[WireGuardPeer]
+PublicKey=AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA=
+AllowedIPs=0.0.0.0/0,::/0
+Endpoint=test:51820
+PersistentKeepalive=25
+`
+
+const testNetworkVal = `[Match]
+Name=wg0
+
+[Network]
+Address=1.1.1.1/32
+Address=1:1::1/128
+DNS=8.8.8.8
+Domains=~.
+
+[RoutingPolicyRule]
+Family=both
+FirewallMark=51820
+InvertRule=true
+Table=51820
+
+[RoutingPolicyRule]
+Family=both
+Table=main
+SuppressPrefixLength=0
+`
+
+const testNMConnectionVal = `[connection]
+id=wg0
+uuid=00000000-0000-4000-8000-000000000000
+type=wireguard
+interface-name=wg0
+
+[wireguard]
+private-key=AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA=
+mtu=1420
+
+[wireguard-peer.AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA=]
+endpoint=test:51820
+persistent-keepalive=25
+allowed-ips=0.0.0.0/0;::/0;
+
+[ipv4]
+method=manual
+address1=1.1.1.1/32
+dns=8.8.8.8;
+
+[ipv6]
+method=manual
+address1=1:1::1/128
+`
+
+func TestNetworkdAndNMConnection(t *testing.T) {
+	mtu := uint16(1420)
+	keepAlive := uint16(25)
+	conf := ClientConfig{
+		Intrfc: Interface{
+			Address: []string{"1.1.1.1/32", "1:1::1/128"},
+			Dns:     []string{"8.8.8.8"},
+			MTU:     &mtu,
+			PostUp:  []string{"echo hello"},
+			Priv:    make([]byte, 32),
+		},
+		Config: Config{Peer: []Peer{{
+			Endpoint:    "test:51820",
+			Ips:         []string{"0.0.0.0/0", "::/0"},
+			KeepAlive:   &keepAlive,
+			Credentials: Credentials{Pub: make([]byte, 32)},
+		}}},
+	}
+
+	netdev, network, warnings, err := conf.MarshalNetworkd("wg0")
+	if err != nil {
+		t.Fatal("error:", err)
+	}
+	if string(netdev) != testNetdevVal || string(network) != testNetworkVal {
+		t.Fatalf("networkd mismatch:\n%s\n%s", netdev, network)
+	}
+	if len(warnings) != 1 || conf.Intrfc.PostUp == nil {
+		t.Fatal("expected a warning for the hook, got", warnings)
+	}
+
+	nm, _, err := conf.MarshalNMConnection("wg0", "00000000-0000-4000-8000-000000000000")
+	if err != nil {
+		t.Fatal("error:", err)
+	}
+	if string(nm) != testNMConnectionVal {
+		t.Fatalf("nmconnection mismatch:\n%s", nm)
+	}
+
+	var invalid *InvalidValueError
+	if _, _, _, err := conf.MarshalNetworkd("a-name-way-too-long"); !errors.As(err, &invalid) {
+		t.Fatal("expected an invalid interface name, got", err)
+	}
+	conf.Intrfc.Table = "vpn"
+	if _, _, err := conf.MarshalNMConnection("wg0", ""); !errors.As(err, &invalid) {
+		t.Fatal("expected an invalid table, got", err)
+	}
+}
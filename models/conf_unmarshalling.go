@@ -0,0 +1,388 @@
+// conf unmarshalling, the inverse of conf marshalling
+package models
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+const (
+	commentChar  = "#"
+	listSep      = ","
+	sectionStart = "["
+	sectionEnd   = "]"
+)
+
+// Position is 1 based, Line is 0 when the values didn't come from conf text (toml tables)
+type ParseError struct {
+	Line   int
+	Column int
+	Msg    string
+}
+
+func (e *ParseError) Error() string {
+	if e.Line == 0 {
+		return e.Msg
+	}
+	return fmt.Sprintf("line %d, column %d: %s", e.Line, e.Column, e.Msg)
+}
+
+type confEntry struct {
+	key      string
+	value    string
+	line     int
+	keyCol   int
+	valueCol int
+	// already a list element, don't split on commas
+	noSplit bool
+	// an empty toml list, sets the list to empty instead of leaving it unset
+	empty bool
+}
+
+func (e confEntry) errorf(col int, format string, args ...any) error {
+	return &ParseError{Line: e.line, Column: col, Msg: fmt.Sprintf(format, args...)}
+}
+
+type confSection struct {
+	name    string
+	line    int
+	col     int
+	entries []confEntry
+	// whole line comments, for the comment field if the type has one
+	comments []string
+}
+
+// leading whitespace as a 1 based column
+func column(line string, offset int) int {
+	return offset + len(line[offset:]) - len(strings.TrimLeft(line[offset:], " \t")) + 1
+}
+
+// Everything after a # is a comment, same as wg-quick. Entries before the first header land in an unnamed section.
+// Whole line comments are kept with the section they're in, or with the next one if they lead right into its header.
+func parseConf(text []byte) ([]confSection, error) {
+	sections := []confSection{{}}
+	scanner := bufio.NewScanner(bytes.NewReader(text))
+	lineNum := 0
+	var pending []string
+	flush := func() {
+		last := &sections[len(sections)-1]
+		last.comments = append(last.comments, pending...)
+		pending = nil
+	}
+
+	for scanner.Scan() {
+		lineNum += 1
+		line := strings.TrimSuffix(scanner.Text(), "\r")
+		if comment, ok := strings.CutPrefix(strings.TrimLeft(line, " \t"), commentChar); ok {
+			pending = append(pending, strings.TrimPrefix(comment, " "))
+			continue
+		}
+		if before, _, found := strings.Cut(line, commentChar); found {
+			line = before
+		}
+		trimmed := strings.TrimSpace(line)
+		if trimmed == "" {
+			flush()
+			continue
+		}
+
+		if strings.HasPrefix(trimmed, sectionStart) {
+			if !strings.HasSuffix(trimmed, sectionEnd) {
+				return nil, &ParseError{Line: lineNum, Column: column(line, 0), Msg: "unterminated section header"}
+			}
+			name := strings.TrimSpace(trimmed[1 : len(trimmed)-1])
+			if name == "" {
+				return nil, &ParseError{Line: lineNum, Column: column(line, 0), Msg: "empty section name"}
+			}
+			sections = append(sections, confSection{name: name, line: lineNum, col: column(line, 0), comments: pending})
+			pending = nil
+			continue
+		}
+
+		key, value, found := strings.Cut(line, "=")
+		if !found {
+			return nil, &ParseError{Line: lineNum, Column: column(line, 0), Msg: "expected key = value"}
+		}
+		entry := confEntry{
+			key:      strings.TrimSpace(key),
+			value:    strings.TrimSpace(value),
+			line:     lineNum,
+			keyCol:   column(line, 0),
+			valueCol: column(line, len(key)+1),
+		}
+		if entry.key == "" {
+			return nil, entry.errorf(entry.keyCol, "missing key")
+		}
+		if entry.value == "" {
+			return nil, entry.errorf(entry.valueCol, "missing value for %s", entry.key)
+		}
+		flush()
+		sections[len(sections)-1].entries = append(sections[len(sections)-1].entries, entry)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	flush()
+	return sections, nil
+}
+
+type confField struct {
+	rv   reflect.Value
+	meta Metadata
+}
+
+// flattens anonymous structs, Peer.Credentials are keys of the same section
+func collectFields(rv reflect.Value, fields []confField) ([]confField, error) {
+	metas, err := typeMetaData(rv.Type())
+	if err != nil {
+		return nil, err
+	}
+	for i, meta := range metas {
+		if meta.anonField {
+			if fields, err = collectFields(rv.Field(i), fields); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		fields = append(fields, confField{rv: rv.Field(i), meta: meta})
+	}
+	return fields, nil
+}
+
+// documents hold sections ([Interface], [Peer]...), everything else is the body of a single section
+func isDocument(fields []confField) bool {
+	for _, val := range fields {
+		kind := val.rv.Kind()
+		if kind == reflect.Struct || (kind == reflect.Slice && val.rv.Type().Elem().Kind() == reflect.Struct) {
+			return true
+		}
+	}
+	return false
+}
+
+func setField(field confField, entry confEntry, seen map[string]bool) error {
+	rv := field.rv
+	name := strings.ToLower(field.meta.name)
+	single := !(rv.Kind() == reflect.Slice && rv.Type().Elem().Kind() == reflect.String)
+	if single && seen[name] {
+		return entry.errorf(entry.keyCol, "duplicate key %s", entry.key)
+	}
+	seen[name] = true
+	if entry.empty && single {
+		return entry.errorf(entry.valueCol, "empty list for %s", entry.key)
+	}
+
+	// set pointers are what tells an explicit zero apart from unset
+	if rv.Kind() == reflect.Pointer {
+		rv.Set(reflect.New(rv.Type().Elem()))
+		rv = rv.Elem()
+	}
+
+	switch {
+	case rv.Kind() == reflect.String:
+		rv.SetString(entry.value)
+	case rv.Kind() == reflect.Bool:
+		val, err := strconv.ParseBool(entry.value)
+		if err != nil {
+			return entry.errorf(entry.valueCol, "invalid bool for %s", entry.key)
+		}
+		rv.SetBool(val)
+	case rv.CanInt():
+		val, err := strconv.ParseInt(entry.value, 0, rv.Type().Bits())
+		if err != nil {
+			return entry.errorf(entry.valueCol, "invalid number for %s: %v", entry.key, errors.Unwrap(err))
+		}
+		rv.SetInt(val)
+	case rv.CanUint():
+		if field.meta.format == formatOff && strings.EqualFold(entry.value, formatOff) {
+			rv.SetUint(0)
+			break
+		}
+		val, err := strconv.ParseUint(entry.value, 0, rv.Type().Bits())
+		if err != nil {
+			return entry.errorf(entry.valueCol, "invalid number for %s: %v", entry.key, errors.Unwrap(err))
+		}
+		rv.SetUint(val)
+	case rv.Kind() == reflect.Slice && rv.Type().Elem().Kind() == reflect.Uint8:
+		buf, err := base64.StdEncoding.DecodeString(entry.value)
+		if err != nil {
+			return entry.errorf(entry.valueCol, "invalid base64 for %s: %v", entry.key, err)
+		}
+		rv.SetBytes(buf)
+	case rv.Kind() == reflect.Slice && rv.Type().Elem().Kind() == reflect.String:
+		if entry.empty {
+			if rv.IsNil() {
+				rv.Set(reflect.MakeSlice(rv.Type(), 0, 0))
+			}
+			break
+		}
+		values := []string{entry.value}
+		if !field.meta.verbatim && !entry.noSplit {
+			values = strings.Split(entry.value, listSep)
+		}
+		for _, val := range values {
+			val = strings.TrimSpace(val)
+			if val == "" {
+				return entry.errorf(entry.valueCol, "empty list element for %s", entry.key)
+			}
+			rv.Set(reflect.Append(rv, reflect.ValueOf(val).Convert(rv.Type().Elem())))
+		}
+	default:
+		return entry.errorf(entry.keyCol, "unsupported type for %s", entry.key)
+	}
+	return nil
+}
+
+func decodeSection(rv reflect.Value, section confSection) error {
+	fields, err := collectFields(rv, nil)
+	if err != nil {
+		return err
+	}
+	seen := make(map[string]bool)
+	for _, entry := range section.entries {
+		idx := slices.IndexFunc(fields, func(f confField) bool { return !f.meta.comment && strings.EqualFold(f.meta.name, entry.key) })
+		if idx < 0 {
+			return entry.errorf(entry.keyCol, "unknown key %s", entry.key)
+		}
+		if err := setField(fields[idx], entry, seen); err != nil {
+			return err
+		}
+	}
+
+	if idx := slices.IndexFunc(fields, func(f confField) bool { return f.meta.comment }); idx >= 0 && len(section.comments) != 0 {
+		fields[idx].rv.SetString(strings.Join(section.comments, "\n"))
+	}
+	return nil
+}
+
+func decodeDocument(fields []confField, sections []confSection) error {
+	// keys before any header
+	if len(sections[0].entries) != 0 {
+		entry := sections[0].entries[0]
+		return entry.errorf(entry.keyCol, "key %s outside of a section", entry.key)
+	}
+
+	seen := make(map[string]bool)
+	for _, section := range sections[1:] {
+		idx := slices.IndexFunc(fields, func(f confField) bool { return strings.EqualFold(f.meta.name, section.name) })
+		if idx < 0 {
+			return &ParseError{Line: section.line, Column: section.col, Msg: fmt.Sprintf("unknown section %s", section.name)}
+		}
+
+		rv := fields[idx].rv
+		if rv.Kind() == reflect.Slice {
+			elem := reflect.New(rv.Type().Elem()).Elem()
+			if err := decodeSection(elem, section); err != nil {
+				return err
+			}
+			rv.Set(reflect.Append(rv, elem))
+			continue
+		}
+
+		name := strings.ToLower(section.name)
+		if seen[name] {
+			return &ParseError{Line: section.line, Column: section.col, Msg: fmt.Sprintf("duplicate section %s", section.name)}
+		}
+		seen[name] = true
+		if err := decodeSection(rv, section); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func confUnmarshallStruct(text []byte, v any) error {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Pointer || rv.Elem().Kind() != reflect.Struct {
+		return errors.New("only called on struct pointers")
+	}
+	rv = rv.Elem()
+
+	sections, err := parseConf(text)
+	if err != nil {
+		return err
+	}
+
+	fields, err := collectFields(rv, nil)
+	if err != nil {
+		return err
+	}
+	if isDocument(fields) {
+		return decodeDocument(fields, sections)
+	}
+	if len(sections) > 1 {
+		return &ParseError{Line: sections[1].line, Column: sections[1].col, Msg: "unexpected section header"}
+	}
+	return decodeSection(rv, sections[0])
+}
+
+// toml tables are mapped onto the same keys as the conf, otherwise the toml decoder
+// would hand the table to UnmarshalText and fail
+func confUnmarshallTOML(data any, v any) error {
+	table, ok := data.(map[string]any)
+	if !ok {
+		return errors.New("expected a table")
+	}
+
+	var section confSection
+	keys := make([]string, 0, len(table))
+	for key := range table {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+
+	for _, key := range keys {
+		values, isList := table[key].([]any)
+		if !isList {
+			values = []any{table[key]}
+		} else if len(values) == 0 {
+			section.entries = append(section.entries, confEntry{key: key, noSplit: true, empty: true})
+		}
+		for _, val := range values {
+			switch val.(type) {
+			case string, int64, bool:
+			default:
+				return fmt.Errorf("unsupported value for %s", key)
+			}
+			section.entries = append(section.entries, confEntry{key: key, value: fmt.Sprint(val), noSplit: true})
+		}
+	}
+	return decodeSection(reflect.ValueOf(v).Elem(), section)
+}
+
+// --- TextUnmarshaler implemented by types ---
+func (v *Credentials) UnmarshalText(text []byte) error {
+	return confUnmarshallStruct(text, v)
+}
+
+func (v *Peer) UnmarshalText(text []byte) error {
+	return confUnmarshallStruct(text, v)
+}
+
+func (v *Interface) UnmarshalText(text []byte) error {
+	return confUnmarshallStruct(text, v)
+}
+
+func (v *Config) UnmarshalText(text []byte) error {
+	return confUnmarshallStruct(text, v)
+}
+
+func (v *ClientConfig) UnmarshalText(text []byte) error {
+	return confUnmarshallStruct(text, v)
+}
+
+func (v *ServerConfig) UnmarshalText(text []byte) error {
+	return confUnmarshallStruct(text, v)
+}
+
+// --- toml.Unmarshaler for the types decoded from the toml confs ---
+func (v *Interface) UnmarshalTOML(data any) error {
+	return confUnmarshallTOML(data, v)
+}
@@ -0,0 +1,239 @@
+package models
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testParseVal = `# written by hand
+[Interface]
+Address = 1.1.1.1/24, 1:1::1/64
+DNS = 8.8.8.8
+FwMark = off
+MTU = 1420
+Table = off
+SaveConfig = true
+PostUp = iptables -A FORWARD -i %i -j ACCEPT, true # comment
+PrivateKey = AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA=
+
+[peer]
+endpoint = test:51820
+AllowedIPs = 2.2.2.2/24
+AllowedIPs = 2:2:2::2/120
+PublicKey = AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA=
+
+# laptop
+#  second line
+[Peer]
+PublicKey = AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA=
+PersistentKeepalive = 0
+`
+
+func TestConfUnmarshalling(t *testing.T) {
+	var zero uint32
+	var zeroKeepAlive uint16
+	mtu := uint16(1420)
+	saveConfig := true
+
+	var conf ClientConfig
+	if err := conf.UnmarshalText([]byte(testParseVal)); err != nil {
+		t.Fatal("error:", err)
+	}
+
+	expected := ClientConfig{
+		Intrfc: Interface{
+			Address:    []string{"1.1.1.1/24", "1:1::1/64"},
+			Dns:        []string{"8.8.8.8"},
+			FwMark:     &zero,
+			MTU:        &mtu,
+			Table:      "off",
+			SaveConfig: &saveConfig,
+			PostUp:     []string{"iptables -A FORWARD -i %i -j ACCEPT, true"},
+			Priv:       make([]byte, 32),
+		},
+		Config: Config{
+			Peer: []Peer{
+				{
+					Endpoint: "test:51820",
+					Ips:      []string{"2.2.2.2/24", "2:2:2::2/120"},
+					Credentials: Credentials{
+						Pub: make([]byte, 32),
+					},
+				},
+				{
+					Comment:   "laptop\n second line",
+					KeepAlive: &zeroKeepAlive,
+					Credentials: Credentials{
+						Pub: make([]byte, 32),
+					},
+				},
+			},
+		},
+	}
+	if !reflect.DeepEqual(conf, expected) {
+		t.Fatalf("unmarshal mismatch: %+v", conf)
+	}
+}
+
+func TestConfUnmarshallingErrors(t *testing.T) {
+	cases := []struct {
+		text   string
+		line   int
+		column int
+	}{
+		{"[Interface]\nAddress 1.1.1.1\n", 2, 1},
+		{"[Interface]\n  Bogus = 1\n", 2, 3},
+		{"[Interface]\nFwMark = 1\nFwMark = 2\n", 3, 1},
+		{"[Interface]\nFwMark =  nope\n", 2, 11},
+		{"[Interface]\nPrivateKey = !!\n", 2, 14},
+		{"[Interface]\n[Interface]\n", 2, 1},
+		{"Address = 1.1.1.1\n", 1, 1},
+		{"[Interface\n", 1, 1},
+		{"[Peers]\n", 1, 1},
+	}
+
+	for _, c := range cases {
+		var conf ClientConfig
+		err := conf.UnmarshalText([]byte(c.text))
+		var parseErr *ParseError
+		if !errors.As(err, &parseErr) {
+			t.Errorf("%q: expected a parse error, got %v", c.text, err)
+			continue
+		}
+		if parseErr.Line != c.line || parseErr.Column != c.column {
+			t.Errorf("%q: expected %d:%d, got %v", c.text, c.line, c.column, err)
+		}
+	}
+}
+
+// values the conf format can't carry are skipped instead of failing
+func representable(vals ...string) bool {
+	for _, val := range vals {
+		if val != strings.TrimSpace(val) || strings.ContainsAny(val, "#,=\r\n[") {
+			return false
+		}
+	}
+	return true
+}
+
+func FuzzConfRoundTrip(f *testing.F) {
+	f.Add("1.1.1.1/24", "8.8.8.8", uint32(51820), "ip link", "test:51820", "2.2.2.2/32", uint16(25), "off", true, "laptop", make([]byte, 32))
+	f.Add("", "", uint32(0), "", "", "", uint16(0), "", false, "", []byte{})
+
+	f.Fuzz(func(t *testing.T, addr string, dns string, fwMark uint32, hook string, endpoint string, ips string, keepAlive uint16, table string, saveConfig bool, comment string, key []byte) {
+		if !representable(addr, dns, hook, endpoint, ips, table) || strings.ContainsAny(comment, "\r\n") || strings.HasPrefix(comment, " ") {
+			t.Skip()
+		}
+		// empty values aren't written, so they come back as nil
+		list := func(val string) []string {
+			if val == "" {
+				return nil
+			}
+			return []string{val}
+		}
+		if len(key) == 0 {
+			key = nil
+		}
+
+		// explicit zeros included
+		conf := ServerConfig{
+			Intrfc: Interface{
+				ListenPort: &keepAlive,
+				Address:    list(addr),
+				Dns:        list(dns),
+				FwMark:     &fwMark,
+				Table:      table,
+				SaveConfig: &saveConfig,
+				PreUp:      list(hook),
+				Priv:       key,
+			},
+			Config: Config{
+				Peer: []Peer{
+					{
+						Comment:     comment,
+						Endpoint:    endpoint,
+						Ips:         list(ips),
+						KeepAlive:   &keepAlive,
+						Credentials: Credentials{Pub: key, Psk: key},
+					},
+				},
+			},
+		}
+
+		text, err := conf.MarshalText()
+		var invalid *InvalidValueError
+		if errors.As(err, &invalid) {
+			t.Skip()
+		} else if err != nil {
+			t.Fatal("marshal error:", err)
+		}
+		var parsed ServerConfig
+		if err := parsed.UnmarshalText(text); err != nil {
+			t.Fatalf("unmarshal error: %v\n%s", err, text)
+		}
+		if !reflect.DeepEqual(conf, parsed) {
+			t.Fatalf("round trip mismatch:\n%s\n%+v", text, parsed)
+		}
+	})
+}
+
+func TestPeerMeta(t *testing.T) {
+	meta := PeerMeta{
+		Name:     "laptop",
+		Cert:     "CN=WG-Client,O=Diamond Is Unbreakable,C=JP",
+		Enrolled: time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC),
+	}
+	peer := Peer{Comment: "kept as is", Credentials: Credentials{Pub: make([]byte, 32)}}
+	peer.SetMeta(meta)
+
+	text, err := peer.MarshalText()
+	if err != nil {
+		t.Fatal("error:", err)
+	}
+	expected := "# wge:name=laptop cert=\"CN=WG-Client,O=Diamond Is Unbreakable,C=JP\" enrolled=2026-01-02T03:04:05Z\n# kept as is\n"
+	if !strings.HasPrefix(string(text), expected) {
+		t.Fatal("unexpected conf:\n", string(text))
+	}
+
+	var parsed Peer
+	if err := parsed.UnmarshalText(text); err != nil {
+		t.Fatal("error:", err)
+	}
+	if got, ok := parsed.Meta(); !ok || got != meta {
+		t.Fatalf("meta mismatch: %+v", got)
+	}
+
+	// setting it again replaces the line instead of adding one
+	parsed.SetMeta(PeerMeta{Name: "desktop"})
+	if parsed.Comment != "wge:name=desktop\nkept as is" {
+		t.Fatalf("unexpected comment: %q", parsed.Comment)
+	}
+
+	for _, val := range []string{"wge:name", "wge:cert=\"unterminated", "wge:enrolled=yesterday"} {
+		if _, ok := (Peer{Comment: val}).Meta(); ok {
+			t.Errorf("%q: expected malformed meta", val)
+		}
+	}
+}
+
+// an empty toml list is set but empty, which is what lets a client override drop the global hooks
+func TestInterfaceOverlay(t *testing.T) {
+	mtu := uint16(1280)
+	global := Interface{PreUp: []string{"echo hello"}, Table: "off", Dns: []string{"8.8.8.8"}}
+
+	var override Interface
+	if err := override.UnmarshalTOML(map[string]any{"PreUp": []any{}, "MTU": int64(mtu)}); err != nil {
+		t.Fatal("error:", err)
+	}
+	expected := Interface{PreUp: []string{}, Table: "off", Dns: []string{"8.8.8.8"}, MTU: &mtu}
+	if merged := global.Overlay(override); !reflect.DeepEqual(merged, expected) {
+		t.Fatalf("overlay mismatch: %+v", merged)
+	}
+
+	if err := new(Interface).UnmarshalTOML(map[string]any{"MTU": []any{}}); err == nil {
+		t.Fatal("expected an error for an empty list of a single value key")
+	}
+}
@@ -9,22 +9,97 @@ type WGEServer struct {
 	IntrfcName        string         `toml:"InterfaceName"`
 	WireguardEndpoint netip.AddrPort `toml:"WireguardEndpoint"`
 	WireguardDns      []netip.Addr   `toml:"WireguardDNS"`
+	StateFile         string         `toml:"StateFile"`
+	KeyFile           string         `toml:"WireguardKeyFile"`
+	ReservedIps       []string       `toml:"ReservedIPs"`
+	AdminSubjects     []string       `toml:"AdminSubjects"`
+	Netlink           bool           `toml:"Netlink"`
+	ServiceManager    string         `toml:"ServiceManager"`
+	RuntimeEnable     bool           `toml:"RuntimeEnable"`
+	OnShutdown        string         `toml:"OnShutdown"`
+	MergeConf         bool           `toml:"MergeExistingConf"`
+	MergeKeepKey      bool           `toml:"MergeKeepPrivateKey"`
+	MergeKeepPort     bool           `toml:"MergeKeepListenPort"`
+	ConfBackups       int            `toml:"ConfBackups"`
+	HistoryDir        string         `toml:"HistoryDir"`
+	HistoryVersions   int            `toml:"HistoryVersions"`
+	WireguardPath     string         `toml:"WireguardPath"`
+	Quotas            Quotas         `toml:"Quotas"`
+	// named AllowedIPs sets clients can ask for, on top of full and vpn
+	Routes map[string][]string `toml:"Routes"`
+	// networks clients may have routed to them, none without any
+	RoutedSubnets []string `toml:"RoutedSubnets"`
+	// subnets of enrolled clients go into the AllowedIPs of clients enrolling after them
+	PushRoutedSubnets bool `toml:"PushRoutedSubnets"`
+}
+
+// Most peers a client cert identity may hold, counted by the cert subject and by each of its O and OU values.
+// The defaults apply to every value without its own entry, 0 is unlimited. Entries are exact, 0 allows none.
+type Quotas struct {
+	PerIdentity int            `toml:"PerIdentity"`
+	PerOrg      int            `toml:"PerOrg"`
+	PerOrgUnit  int            `toml:"PerOrgUnit"`
+	Identities  map[string]int `toml:"Identities"`
+	Orgs        map[string]int `toml:"Orgs"`
+	OrgUnits    map[string]int `toml:"OrgUnits"`
 }
 
 type WgClient struct {
 	Name       string `toml:"Name"`
 	GenerateQR bool   `toml:"GenerateQR"`
+	// linux, android, ios or router, decides the keys written and the checks on the conf
+	Platform Platform `toml:"Platform"`
+	// wg-quick (default), networkd or networkmanager
+	Format OutputFormat `toml:"Format"`
+	// on top of the global [Interface], Address and PrivateKey come from the server
+	Interface *Interface `toml:"Interface"`
+	KeepAlive *uint16    `toml:"PersistentKeepAlive"`
+	// full, vpn or one of the server's route sets, what the server hands out if unset
+	Routes string `toml:"Routes"`
+	// taken out of the AllowedIPs the server hands out, e.g. the LAN the client sits in
+	ExcludeIps []string `toml:"ExcludeIPs"`
+	// networks behind the client, e.g. the LAN of a router, for the server to route to it
+	Subnets []string `toml:"Subnets"`
 }
 
 type WGEClient struct {
 	Clients   []WgClient `toml:"WgClients"`
-	KeepAlive int8       `toml:"PersistentKeepAlive"`
+	KeepAlive *uint16    `toml:"PersistentKeepAlive"`
+}
+
+// Enrollment rule, the first one matching the request decides. Set match fields all have to match,
+// within one any value does. Subject fields and SANs are shell patterns (path.Match).
+type PolicyRule struct {
+	Name string `toml:"Name"`
+	// allow or deny
+	Action     string   `toml:"Action"`
+	CommonName []string `toml:"CommonName"`
+	Org        []string `toml:"Org"`
+	OrgUnit    []string `toml:"OrgUnit"`
+	// DNS:, email:, IP: or URI: prefixed, same as they're recorded
+	SAN []string `toml:"SAN"`
+	// prefixes the request's source address has to be in
+	Source []string `toml:"Source"`
+
+	// what an allowed enrollment gets, the server defaults otherwise
+	// ranges or prefixes inside the interface networks, see ReservedIPs for the notation
+	Pool       []string `toml:"Pool"`
+	AllowedIps []string `toml:"AllowedIPs"`
+	// route sets the client may ask for, the first one is the default unless AllowedIPs is set.
+	// Setting either keeps the client from asking for any other set.
+	Routes []string `toml:"Routes"`
+	// taken out of whichever AllowedIPs the client ends up with
+	ExcludeIps []string `toml:"ExcludeIPs"`
+	Dns        []string `toml:"DNS"`
+	KeepAlive  *uint16  `toml:"PersistentKeepAlive"`
 }
 
 // Skipping peer stuff here
 type WGEServerConf struct {
-	Server      WGEServer       `toml:"Server"`
-	WgInterface ServerInterface `toml:"Interface"`
+	Server      WGEServer `toml:"Server"`
+	WgInterface Interface `toml:"Interface"`
+	// empty allows every verified client cert, otherwise requests no rule matches are denied
+	Policy []PolicyRule `toml:"Policy"`
 }
 
 type WGEClientConf struct {
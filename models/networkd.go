@@ -0,0 +1,204 @@
+// systemd-networkd .netdev/.network output of the confs, and the output formats of the client confs
+package models
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/netip"
+	"strconv"
+	"strings"
+)
+
+const (
+	// same table and fwmark wg-quick uses for a peer routing everything
+	fullTunnelTable = 51820
+
+	maxIfnameLen = 15
+)
+
+// wg-quick only, neither networkd nor NetworkManager have anything like them
+var wgQuickKeys = []string{"SaveConfig", "PreUp", "PostUp", "PreDown", "PostDown"}
+
+type OutputFormat string
+
+const (
+	// unset is wg-quick
+	FormatWgQuick        OutputFormat = "wg-quick"
+	FormatNetworkd       OutputFormat = "networkd"
+	FormatNetworkManager OutputFormat = "networkmanager"
+)
+
+func (f OutputFormat) WgQuick() bool {
+	return f == "" || f == FormatWgQuick
+}
+
+func (f *OutputFormat) UnmarshalText(text []byte) error {
+	switch val := OutputFormat(text); val {
+	case "", FormatWgQuick, FormatNetworkd, FormatNetworkManager:
+		*f = val
+		return nil
+	default:
+		return fmt.Errorf("unknown format %q, expected wg-quick, networkd or networkmanager", text)
+	}
+}
+
+// key = value sections, the layout of both networkd units and NetworkManager keyfiles
+type iniSection struct {
+	name    string
+	entries []string
+}
+
+// empty values are left out
+func (s *iniSection) add(key string, val string) {
+	if val != "" {
+		s.entries = append(s.entries, fmt.Sprintf("%s=%s", key, val))
+	}
+}
+
+func writeIni(sections []*iniSection) []byte {
+	var buffer bytes.Buffer
+	for i, val := range sections {
+		if i != 0 {
+			buffer.WriteString("\n")
+		}
+		fmt.Fprintf(&buffer, "[%s]\n", val.name)
+		for _, entry := range val.entries {
+			buffer.WriteString(entry + "\n")
+		}
+	}
+	return buffer.Bytes()
+}
+
+func optional[T uint16 | uint32](val *T) string {
+	if val == nil {
+		return ""
+	}
+	return strconv.FormatUint(uint64(*val), 10)
+}
+
+func encodeKey(key Key) string {
+	if len(key) == 0 {
+		return ""
+	}
+	return base64.StdEncoding.EncodeToString(key)
+}
+
+// the file name is the interface name for wg-quick, these take it from the file contents instead
+func validateIfname(name string) error {
+	if name == "" || len(name) > maxIfnameLen || strings.ContainsAny(name, "/: \t\n") {
+		return &InvalidValueError{Field: "interface name", Value: name, Err: errors.New("not a valid interface name")}
+	}
+	return nil
+}
+
+// the checks of the wg-quick conf, plus the interface name and the keys left out with a warning each
+func prepareConf(name string, intrfc *Interface, peers []Peer, target string) ([]string, error) {
+	if err := validateIfname(name); err != nil {
+		return nil, err
+	}
+	if _, err := (ServerConfig{Intrfc: *intrfc, Config: Config{Peer: peers}}).MarshalText(); err != nil {
+		return nil, err
+	}
+	return dropUnsupported(intrfc, wgQuickKeys, target)
+}
+
+// a peer taking all the traffic needs the fwmark policy routing wg-quick sets up, or the tunnel routes itself
+func isFullTunnel(peers []Peer) bool {
+	for _, peer := range peers {
+		for _, val := range peer.Ips {
+			if prefix, err := netip.ParsePrefix(val); err == nil && prefix.Bits() == 0 {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+/** --- systemd-networkd --- */
+
+// wg-quick's Table as networkd sees it, off adds no routes and auto is the main table unless it's a full tunnel
+func networkdTable(intrfc Interface, fullTunnel bool) string {
+	switch intrfc.Table {
+	case "off":
+		return ""
+	case "", "auto":
+		if fullTunnel {
+			return strconv.Itoa(fullTunnelTable)
+		}
+		return "main"
+	default:
+		return intrfc.Table
+	}
+}
+
+func renderNetworkd(name string, intrfc Interface, peers []Peer) (netdev []byte, network []byte, warnings []string, err error) {
+	if warnings, err = prepareConf(name, &intrfc, peers, string(FormatNetworkd)); err != nil {
+		return nil, nil, warnings, err
+	}
+	fullTunnel := isFullTunnel(peers) && (intrfc.Table == "" || intrfc.Table == "auto")
+	fwMark := optional(intrfc.FwMark)
+	if fullTunnel && fwMark == "" {
+		fwMark = strconv.Itoa(fullTunnelTable)
+	}
+
+	dev := &iniSection{name: "NetDev"}
+	dev.add("Name", name)
+	dev.add("Kind", "wireguard")
+	dev.add("MTUBytes", optional(intrfc.MTU))
+
+	wg := &iniSection{name: "WireGuard"}
+	wg.add("PrivateKey", encodeKey(intrfc.Priv))
+	wg.add("ListenPort", optional(intrfc.ListenPort))
+	wg.add("FirewallMark", fwMark)
+	wg.add("RouteTable", networkdTable(intrfc, fullTunnel))
+
+	netdevSections := []*iniSection{dev, wg}
+	for _, peer := range peers {
+		sec := &iniSection{name: "WireGuardPeer"}
+		sec.add("PublicKey", encodeKey(peer.Pub))
+		sec.add("PresharedKey", encodeKey(peer.Psk))
+		sec.add("AllowedIPs", strings.Join(peer.Ips, ","))
+		sec.add("Endpoint", peer.Endpoint)
+		sec.add("PersistentKeepalive", optional(peer.KeepAlive))
+		netdevSections = append(netdevSections, sec)
+	}
+
+	match := &iniSection{name: "Match"}
+	match.add("Name", name)
+	net := &iniSection{name: "Network"}
+	for _, val := range intrfc.Address {
+		net.add("Address", val)
+	}
+	for _, val := range intrfc.Dns {
+		net.add("DNS", val)
+	}
+	networkSections := []*iniSection{match, net}
+	if fullTunnel {
+		// every lookup goes through the tunnel, and the rules wg-quick would add
+		if len(intrfc.Dns) != 0 {
+			net.add("Domains", "~.")
+		}
+		notMarked := &iniSection{name: "RoutingPolicyRule"}
+		notMarked.add("Family", "both")
+		notMarked.add("FirewallMark", fwMark)
+		notMarked.add("InvertRule", "true")
+		notMarked.add("Table", strconv.Itoa(fullTunnelTable))
+		suppress := &iniSection{name: "RoutingPolicyRule"}
+		suppress.add("Family", "both")
+		suppress.add("Table", "main")
+		suppress.add("SuppressPrefixLength", "0")
+		networkSections = append(networkSections, notMarked, suppress)
+	}
+	return writeIni(netdevSections), writeIni(networkSections), warnings, nil
+}
+
+// .netdev and .network pair for /etc/systemd/network, the .netdev has the private key so it has to be 0640 root:systemd-network
+func (v ClientConfig) MarshalNetworkd(name string) (netdev []byte, network []byte, warnings []string, err error) {
+	return renderNetworkd(name, v.Intrfc, v.Peer)
+}
+
+func (v ServerConfig) MarshalNetworkd(name string) (netdev []byte, network []byte, warnings []string, err error) {
+	return renderNetworkd(name, v.Intrfc, v.Peer)
+}
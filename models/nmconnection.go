@@ -0,0 +1,102 @@
+// NetworkManager keyfile output of the client conf
+package models
+
+import (
+	"errors"
+	"fmt"
+	"net/netip"
+	"strconv"
+	"strings"
+)
+
+// NetworkManager keyfile for /etc/NetworkManager/system-connections, only read by NM when it's 0600 and owned by root
+func (v ClientConfig) MarshalNMConnection(name string, uuid string) (text []byte, warnings []string, err error) {
+	intrfc := v.Intrfc
+	if warnings, err = prepareConf(name, &intrfc, v.Peer, string(FormatNetworkManager)); err != nil {
+		return nil, warnings, err
+	}
+
+	conn := &iniSection{name: "connection"}
+	conn.add("id", name)
+	conn.add("uuid", uuid)
+	conn.add("type", "wireguard")
+	conn.add("interface-name", name)
+
+	wg := &iniSection{name: "wireguard"}
+	wg.add("private-key", encodeKey(intrfc.Priv))
+	wg.add("listen-port", optional(intrfc.ListenPort))
+	wg.add("fwmark", optional(intrfc.FwMark))
+	wg.add("mtu", optional(intrfc.MTU))
+
+	// NM sets up the full tunnel policy routing by itself, only the table is ours to pick
+	routeTable := ""
+	switch intrfc.Table {
+	case "", "auto":
+	case "off":
+		wg.add("peer-routes", "false")
+	default:
+		if _, err := strconv.ParseUint(intrfc.Table, 10, 32); err != nil {
+			return nil, warnings, &InvalidValueError{Field: "Table", Value: intrfc.Table, Err: errors.New("only numbered tables on networkmanager")}
+		}
+		routeTable = intrfc.Table
+	}
+
+	sections := []*iniSection{conn, wg}
+	for _, peer := range v.Peer {
+		sec := &iniSection{name: fmt.Sprintf("wireguard-peer.%s", encodeKey(peer.Pub))}
+		sec.add("endpoint", peer.Endpoint)
+		if len(peer.Psk) != 0 {
+			sec.add("preshared-key", encodeKey(peer.Psk))
+			// stored in the keyfile, not in a secret agent
+			sec.add("preshared-key-flags", "0")
+		}
+		sec.add("persistent-keepalive", optional(peer.KeepAlive))
+		// ; terminated lists
+		if len(peer.Ips) != 0 {
+			sec.add("allowed-ips", strings.Join(peer.Ips, ";")+";")
+		}
+		sections = append(sections, sec)
+	}
+
+	// addresses and dns split by family, a family without addresses is disabled
+	var addrs4, addrs6, dns4, dns6 []string
+	for _, val := range intrfc.Address {
+		if prefix, _ := netip.ParsePrefix(val); prefix.Addr().Is6() {
+			addrs6 = append(addrs6, val)
+		} else {
+			addrs4 = append(addrs4, val)
+		}
+	}
+	for _, val := range intrfc.Dns {
+		addr, err := netip.ParseAddr(val)
+		if err != nil {
+			return nil, warnings, &InvalidValueError{Field: "DNS", Value: val, Err: errors.New("only addresses on networkmanager")}
+		}
+		if addr.Is6() {
+			dns6 = append(dns6, val)
+		} else {
+			dns4 = append(dns4, val)
+		}
+	}
+	ipv4 := nmIPSection("ipv4", addrs4, dns4, routeTable)
+	ipv6 := nmIPSection("ipv6", addrs6, dns6, routeTable)
+	return writeIni(append(sections, ipv4, ipv6)), warnings, nil
+}
+
+func nmIPSection(family string, addrs []string, dns []string, routeTable string) *iniSection {
+	sec := &iniSection{name: family}
+	if len(addrs) == 0 {
+		sec.add("method", "disabled")
+		return sec
+	}
+	sec.add("method", "manual")
+	for i, val := range addrs {
+		sec.add(fmt.Sprintf("address%d", i+1), val)
+	}
+	// ; terminated lists
+	if len(dns) != 0 {
+		sec.add("dns", strings.Join(dns, ";")+";")
+	}
+	sec.add("route-table", routeTable)
+	return sec
+}
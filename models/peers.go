@@ -0,0 +1,131 @@
+package models
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// route sets every server has, besides the ones of its [Server.Routes]
+const (
+	// 0.0.0.0/0 and ::/0, everything through the server
+	RoutesFull = "full"
+	// only the networks of the server's interface
+	RoutesVPN = "vpn"
+)
+
+// Body of the enrollment request
+type EnrollRequest struct {
+	Credentials
+	Name string
+	// route set the client wants as AllowedIPs, the server decides if empty
+	Routes string
+	// networks behind the client the server should route to it, site to site
+	Subnets []string
+}
+
+// Read only view of an enrolled peer, returned by the peer listing
+type PeerInfo struct {
+	Name       string    `json:"name,omitempty"`
+	PublicKey  Key       `json:"publicKey"`
+	Address    []string  `json:"address"`
+	Enrolled   time.Time `json:"enrolled"`
+	Subject    string    `json:"subject,omitempty"`
+	RemoteAddr string    `json:"remoteAddr,omitempty"`
+	// of the verified client cert that enrolled it
+	SANs        []string `json:"sans,omitempty"`
+	Fingerprint string   `json:"fingerprint,omitempty"`
+	// routed to the peer besides its addresses
+	Subnets []string `json:"subnets,omitempty"`
+}
+
+const peerMetaPrefix = "wge:"
+
+// Structured comment line of a [Peer] block, # wge:name=laptop cert="CN=..." enrolled=<RFC 3339>
+type PeerMeta struct {
+	Name     string
+	Cert     string
+	Enrolled time.Time
+}
+
+// quoted only when it wouldn't survive the split on spaces
+func quoteMetaValue(val string) string {
+	if strings.IndexFunc(val, func(r rune) bool { return unicode.IsSpace(r) || r == '"' || r == '=' || !unicode.IsPrint(r) }) >= 0 {
+		return strconv.Quote(val)
+	}
+	return val
+}
+
+func (m PeerMeta) String() string {
+	fields := make([]string, 0, 3)
+	if m.Name != "" {
+		fields = append(fields, "name="+quoteMetaValue(m.Name))
+	}
+	if m.Cert != "" {
+		fields = append(fields, "cert="+quoteMetaValue(m.Cert))
+	}
+	if !m.Enrolled.IsZero() {
+		fields = append(fields, "enrolled="+m.Enrolled.UTC().Format(time.RFC3339))
+	}
+	return peerMetaPrefix + strings.Join(fields, " ")
+}
+
+// unknown keys are skipped, they might come from a newer version
+func parsePeerMeta(line string) (meta PeerMeta, err error) {
+	for rest := strings.TrimLeft(line, " "); rest != ""; rest = strings.TrimLeft(rest, " ") {
+		key, after, found := strings.Cut(rest, "=")
+		if !found || key == "" || strings.Contains(key, " ") {
+			return meta, fmt.Errorf("expected key=value at %q", rest)
+		}
+
+		var val string
+		if strings.HasPrefix(after, `"`) {
+			quoted, err := strconv.QuotedPrefix(after)
+			if err != nil {
+				return meta, fmt.Errorf("invalid quoted %s: %w", key, err)
+			}
+			val, _ = strconv.Unquote(quoted)
+			rest = after[len(quoted):]
+		} else {
+			val, rest, _ = strings.Cut(after, " ")
+		}
+
+		switch key {
+		case "name":
+			meta.Name = val
+		case "cert":
+			meta.Cert = val
+		case "enrolled":
+			if meta.Enrolled, err = time.Parse(time.RFC3339, val); err != nil {
+				return meta, err
+			}
+		}
+	}
+	return meta, nil
+}
+
+// From the first wge: line of the comment, false if there is none or it's malformed
+func (p Peer) Meta() (PeerMeta, bool) {
+	for _, line := range strings.Split(p.Comment, "\n") {
+		if rest, ok := strings.CutPrefix(line, peerMetaPrefix); ok {
+			meta, err := parsePeerMeta(rest)
+			return meta, err == nil
+		}
+	}
+	return PeerMeta{}, false
+}
+
+// Replaces the wge: line, any other comment lines are kept after it
+func (p *Peer) SetMeta(meta PeerMeta) {
+	lines := []string{meta.String()}
+	if p.Comment != "" {
+		for _, line := range strings.Split(p.Comment, "\n") {
+			if !strings.HasPrefix(line, peerMetaPrefix) {
+				lines = append(lines, line)
+			}
+		}
+	}
+	p.Comment = strings.Join(lines, "\n")
+}
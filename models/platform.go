@@ -0,0 +1,124 @@
+// client conf profiles for the platforms the confs are handed to
+package models
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"slices"
+)
+
+type Platform string
+
+const (
+	// unset, everything is written as is, same as linux
+	PlatformAny     Platform = ""
+	PlatformLinux   Platform = "linux"
+	PlatformAndroid Platform = "android"
+	PlatformIOS     Platform = "ios"
+	PlatformRouter  Platform = "router"
+
+	// the mobile apps hand the MTU to the OS VPN API, which refuses less than the IPv6 minimum
+	mobileMinMTU = 1280
+)
+
+type platformProfile struct {
+	// [Interface] keys the platform doesn't take, by toml name
+	unsupported []string
+	// a phone is never reachable, it has to dial the server
+	mobile bool
+	// imports confs from QR codes
+	qr bool
+}
+
+var (
+	wgQuickOnly = []string{"Table", "SaveConfig", "PreUp", "PostUp", "PreDown", "PostDown"}
+
+	platformProfiles = map[Platform]platformProfile{
+		PlatformAny:     {qr: true},
+		PlatformLinux:   {},
+		PlatformAndroid: {unsupported: append([]string{"FwMark"}, wgQuickOnly...), mobile: true, qr: true},
+		PlatformIOS:     {unsupported: append([]string{"FwMark"}, wgQuickOnly...), mobile: true, qr: true},
+		// plain wg confs plus Address/DNS, what the router UIs import
+		PlatformRouter: {unsupported: wgQuickOnly},
+	}
+)
+
+func (p *Platform) UnmarshalText(text []byte) error {
+	if _, ok := platformProfiles[Platform(text)]; !ok {
+		return fmt.Errorf("unknown platform %q, expected linux, android, ios or router", text)
+	}
+	*p = Platform(text)
+	return nil
+}
+
+// networkd and NetworkManager hosts
+func (p Platform) Linux() bool {
+	return p == PlatformAny || p == PlatformLinux
+}
+
+// Whether a QR code of the conf is of any use to the platform
+func (p Platform) QR() bool {
+	return platformProfiles[p].qr
+}
+
+// Set keys of intrfc listed in unsupported are reset, with a warning each.
+// The lists are shared with the caller's copy, only the fields themselves are reset.
+func dropUnsupported(intrfc *Interface, unsupported []string, target string) ([]string, error) {
+	rv := reflect.ValueOf(intrfc).Elem()
+	metas, err := typeMetaData(rv.Type())
+	if err != nil {
+		return nil, err
+	}
+	var warnings []string
+	for i, meta := range metas {
+		if !slices.Contains(unsupported, meta.name) || rv.Field(i).IsZero() {
+			continue
+		}
+		warnings = append(warnings, fmt.Sprintf("%s is not supported on %s, left out", meta.name, target))
+		rv.Field(i).SetZero()
+	}
+	return warnings, nil
+}
+
+// The conf as the platform takes it. Set keys the platform doesn't know are left out with a warning each,
+// the conf is validated against what the platform requires.
+func (v ClientConfig) ForPlatform(platform Platform) (conf ClientConfig, warnings []string, err error) {
+	profile, ok := platformProfiles[platform]
+	if !ok {
+		return v, nil, fmt.Errorf("unknown platform %q", platform)
+	}
+	if warnings, err = dropUnsupported(&v.Intrfc, profile.unsupported, string(platform)); err != nil {
+		return v, nil, err
+	}
+	return v, warnings, validatePlatform(v, platform, profile)
+}
+
+func validatePlatform(v ClientConfig, platform Platform, profile platformProfile) error {
+	invalid := func(field string, err error) error {
+		return &InvalidValueError{Field: field, Err: fmt.Errorf("%w on %s", err, platform)}
+	}
+
+	if len(v.Intrfc.Address) == 0 {
+		return invalid("Address", errors.New("required"))
+	}
+	if len(v.Intrfc.Priv) == 0 {
+		return invalid("PrivateKey", errors.New("required"))
+	}
+	if len(v.Peer) == 0 {
+		return invalid("Peer", errors.New("required"))
+	}
+	if !profile.mobile {
+		return nil
+	}
+
+	if v.Intrfc.MTU != nil && *v.Intrfc.MTU < mobileMinMTU {
+		return invalid("MTU", fmt.Errorf("less than %d", mobileMinMTU))
+	}
+	for _, val := range v.Peer {
+		if val.Endpoint == "" {
+			return invalid("Endpoint", errors.New("required"))
+		}
+	}
+	return nil
+}
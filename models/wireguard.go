@@ -1,5 +1,7 @@
 package models
 
+import "reflect"
+
 type Key []byte
 
 type Credentials struct {
@@ -7,27 +9,43 @@ type Credentials struct {
 	Psk Key `toml:"PresharedKey"`
 }
 
+// nil pointers are left out of the conf, set ones are written even when zero
 type Peer struct {
-	Endpoint  string   `toml:"Endpoint"`
-	Ips       []string `toml:"AllowedIPs" singleline:"true"`
-	KeepAlive int8     `toml:"PersistentKeepAlive"`
+	// written as # lines at the top of the block
+	Comment   string   `toml:"Comment" comment:"true"`
+	Endpoint  string   `toml:"Endpoint" format:"hostport"`
+	Ips       []string `toml:"AllowedIPs" singleline:"true" format:"prefix"`
+	KeepAlive *uint16  `toml:"PersistentKeepAlive"`
 	Credentials
 }
 
 type Interface struct {
-	Address  []string `toml:"Address"`
-	Dns      []string `toml:"DNS"`
-	FwMark   int32    `toml:"FwMark"`
-	PreUp    []string `toml:"PreUp"`
-	PostUp   []string `toml:"PostUp"`
-	PreDown  []string `toml:"PreDown"`
-	PostDown []string `toml:"PostDown"`
-	Priv     Key      `toml:"PrivateKey"`
+	ListenPort *uint16  `toml:"ListenPort"`
+	Address    []string `toml:"Address" format:"prefix"`
+	Dns        []string `toml:"DNS"`
+	FwMark     *uint32  `toml:"FwMark" format:"off"`
+	MTU        *uint16  `toml:"MTU"`
+	// off, auto or a routing table
+	Table      string   `toml:"Table" format:"table"`
+	SaveConfig *bool    `toml:"SaveConfig"`
+	PreUp      []string `toml:"PreUp" verbatim:"true"`
+	PostUp     []string `toml:"PostUp" verbatim:"true"`
+	PreDown    []string `toml:"PreDown" verbatim:"true"`
+	PostDown   []string `toml:"PostDown" verbatim:"true"`
+	Priv       Key      `toml:"PrivateKey"`
 }
 
-type ServerInterface struct {
-	ListenPort int32 `toml:"ListenPort"`
-	Interface
+// Every field set in override replaces the one of i, an empty but non nil list counts as set,
+// that's how a client drops the hooks of the global [Interface]
+func (i Interface) Overlay(override Interface) Interface {
+	rv := reflect.ValueOf(&i).Elem()
+	ov := reflect.ValueOf(override)
+	for idx := range rv.NumField() {
+		if !ov.Field(idx).IsZero() {
+			rv.Field(idx).Set(ov.Field(idx))
+		}
+	}
+	return i
 }
 
 type Config struct {
@@ -35,7 +53,7 @@ type Config struct {
 }
 
 type ServerConfig struct {
-	Intrfc ServerInterface `toml:"Interface"`
+	Intrfc Interface `toml:"Interface"`
 	Config
 }
 